@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"kademlia/constants"
+	"kademlia/models"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// keygen writes a new identity: the private key, readable only by the
+// current user, and the base64 public key other nodes list in their
+// authorized_keys.
+func keygen(args []string) {
+	flags := flag.NewFlagSet("keygen", flag.ExitOnError)
+	out := flags.String("out", "priv_key.pem", "file to write the private key to")
+	pub := flags.String("pub", "pub_key", "file to write the base64 public key to")
+	force := flags.Bool("force", false, "overwrite existing key files")
+	passphraseFile := flags.String("passphrase-file", "", "file holding a passphrase to encrypt the key with, instead of $KADEMLIA_PASSPHRASE")
+	flags.Parse(args)
+
+	if !*force {
+		for _, path := range []string{*out, *pub} {
+			if _, err := os.Stat(path); err == nil {
+				log.Fatalf("%s already exists, use -force to overwrite it", path)
+			}
+		}
+	}
+	passphrase, err := readPassphrase(*passphraseFile)
+	if err != nil {
+		log.Fatalf("error while reading passphrase %v", err)
+	}
+	identity, err := models.NewIdentity()
+	if err != nil {
+		log.Fatalf("error while generating key %v", err)
+	}
+	if err := identity.Save(*out, passphrase); err != nil {
+		log.Fatalf("error while writing private key %v", err)
+	}
+	encoded := base64.StdEncoding.EncodeToString(identity.PublicKey())
+	if err := ioutil.WriteFile(*pub, []byte(encoded+"\n"), 0644); err != nil {
+		log.Fatalf("error while writing public key %v", err)
+	}
+	fmt.Println("public key:", encoded)
+	fmt.Println("author id: ", identity.ID)
+}
+
+// crawl crawls the network without joining it: peers answer find node
+// requests from any address, so no server needs to listen.
+func crawl(args []string) {
+	flags := flag.NewFlagSet("crawl", flag.ExitOnError)
+	format := flags.String("format", "json", "json or csv")
+	limit := flags.Int("limit", constants.CRAWL_LIMIT, "most nodes to query")
+	logLevel := flags.String("log-level", "warn", "minimum level to log: debug, info, warn or error")
+	flags.Parse(args)
+	if flags.NArg() == 0 || (*format != "json" && *format != "csv") {
+		usage()
+		os.Exit(2)
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		log.Fatalf("invalid log level %v", err)
+	}
+	server := models.Server{Log: models.NewLogger(os.Stderr, level, false)}
+	server.Addr = &net.UDPAddr{IP: GetOutboundIP(), Port: 4444}
+	server.ID = models.NodeID(server.Addr.IP)
+	var seeds []models.Tuple
+	for _, arg := range flags.Args() {
+		addr, err := net.ResolveUDPAddr("udp", arg+":4444")
+		if err != nil {
+			log.Fatalf("error while resolving %s %v", arg, err)
+		}
+		seeds = append(seeds, models.Tuple{Addr: addr, Difficulty: 3})
+	}
+	topology := server.CrawlFrom(seeds, *limit)
+	if *format == "csv" {
+		if err := models.WriteCrawlCSV(os.Stdout, topology); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(topology); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// adminClient talks to the admin API of a running node.
+type adminClient struct {
+	addr  string
+	token string
+}
+
+func (c adminClient) do(method string, path string, query url.Values, body io.Reader) ([]byte, error) {
+	target := "http://" + c.addr + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	client := http.Client{Timeout: 10 * time.Minute}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(data, &apiErr) == nil && apiErr.Error != "" {
+			return nil, errors.New(apiErr.Error)
+		}
+		return nil, errors.New(resp.Status)
+	}
+	return data, nil
+}
+
+func (c adminClient) get(path string, query url.Values, v interface{}) error {
+	data, err := c.do(http.MethodGet, path, query, nil)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (c adminClient) post(path string, query url.Values, body io.Reader, v interface{}) error {
+	data, err := c.do(http.MethodPost, path, query, body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// query runs one of the commands that ask a running node something through
+// its admin API.
+func query(command string, args []string) {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	adminAddr := flags.String("admin", constants.ADMIN_ADDR, "address of the node's admin API")
+	tokenFile := flags.String("admin-token", "admin_token", "file holding the admin API token")
+	topic := flags.String("topic", "", "topic to publish to instead of the chain (publish)")
+	keyFile := flags.String("key", "priv_key.pem", "private key to sign with (publish)")
+	passphraseFile := flags.String("passphrase-file", "", "file holding the passphrase of the private key (publish)")
+	format := flags.String("format", "json", "json or dot, or csv for topology (export)")
+	limit := flags.Int("limit", constants.CRAWL_LIMIT, "most nodes to crawl (export topology)")
+	flags.Parse(args)
+	args = flags.Args()
+
+	token, err := ioutil.ReadFile(*tokenFile)
+	if err != nil {
+		log.Fatalf("error while reading admin token %v", err)
+	}
+	client := adminClient{addr: *adminAddr, token: strings.TrimSpace(string(token))}
+
+	if command == "ping" && len(args) == 1 {
+		err = ping(client, args[0])
+	} else if command == "lookup" && len(args) == 1 {
+		err = lookup(client, args[0])
+	} else if command == "put" && len(args) <= 1 {
+		err = put(client, args)
+	} else if command == "get" && len(args) == 1 {
+		err = get(client, args[0])
+	} else if command == "publish" && len(args) >= 1 {
+		err = publish(client, *keyFile, *passphraseFile, *topic, strings.Join(args, " "))
+	} else if command == "table" && len(args) == 0 {
+		err = table(client)
+	} else if command == "size" && len(args) == 0 {
+		err = size(client)
+	} else if command == "export" && len(args) == 1 {
+		err = export(client, args[0], *format, *limit)
+	} else {
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func ping(client adminClient, target string) error {
+	params := url.Values{}
+	if models.ValidID(target) {
+		params.Set("id", target)
+	} else {
+		params.Set("addr", target)
+	}
+	var result models.PingResult
+	if err := client.post("/ping", params, nil, &result); err != nil {
+		return err
+	}
+	if !result.Alive {
+		return fmt.Errorf("%s did not answer", result.ID)
+	}
+	fmt.Println(result.ID, "time="+result.RTT.String())
+	return nil
+}
+
+func lookup(client adminClient, id string) error {
+	var peers []models.PeerInfo
+	if err := client.get("/lookup", url.Values{"id": {id}}, &peers); err != nil {
+		return err
+	}
+	for _, peer := range peers {
+		fmt.Println(peer.ID, peer.Addr)
+	}
+	return nil
+}
+
+func put(client adminClient, args []string) error {
+	var value []byte
+	var err error
+	if len(args) == 1 {
+		value = []byte(args[0])
+	} else if value, err = ioutil.ReadAll(os.Stdin); err != nil {
+		return err
+	}
+	var result map[string]string
+	if err := client.post("/blobs", nil, bytes.NewReader(value), &result); err != nil {
+		return err
+	}
+	fmt.Println(result["key"])
+	return nil
+}
+
+func get(client adminClient, key string) error {
+	value, err := client.do(http.MethodGet, "/blobs", url.Values{"key": {key}}, nil)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(value)
+	return err
+}
+
+func publish(client adminClient, keyFile string, passphraseFile string, topic string, msg string) error {
+	passphrase, err := readPassphrase(passphraseFile)
+	if err != nil {
+		return err
+	}
+	identity, err := models.LoadIdentity(keyFile, passphrase)
+	if err != nil {
+		return err
+	}
+	event := &models.Event{Topic: topic, Time: time.Now().Unix(), Data: msg}
+	identity.Sign(event)
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	var published models.Event
+	if err := client.post("/events", nil, bytes.NewReader(body), &published); err != nil {
+		return err
+	}
+	if published.Hash != "" {
+		fmt.Println(published.Hash)
+	}
+	return nil
+}
+
+func table(client adminClient) error {
+	var buckets []models.BucketInfo
+	if err := client.get("/table", nil, &buckets); err != nil {
+		return err
+	}
+	for i, bucket := range buckets {
+		fmt.Printf("bucket %d (%d/%d)\n", i, len(bucket.Peers), bucket.K)
+		for _, peer := range bucket.Peers {
+			seen := "never"
+			if !peer.LastSeen.IsZero() {
+				seen = time.Since(peer.LastSeen).Round(time.Second).String() + " ago"
+			}
+			fmt.Printf("  %s %-21s rtt=%s seen=%s\n", peer.ID, peer.Addr, peer.RTT, seen)
+		}
+	}
+	return nil
+}
+
+func size(client adminClient) error {
+	var size models.SizeEstimate
+	if err := client.get("/size", nil, &size); err != nil {
+		return err
+	}
+	fmt.Printf("%.0f nodes (routing table %.0f, %d lookups averaging %.0f), storing values on %d peers\n",
+		size.Estimate, size.Table, size.Samples, size.Lookups, size.Replicas)
+	return nil
+}
+
+func export(client adminClient, what string, format string, limit int) error {
+	params := url.Values{"format": {format}}
+	if what == "topology" {
+		params.Set("limit", strconv.Itoa(limit))
+	}
+	data, err := client.do(http.MethodGet, "/export/"+what, params, nil)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
@@ -1,6 +1,62 @@
 package constants
 
 const (
-	KEY_LENGTH = 540
-	BUFFER     = 4096
+	KEY_LENGTH         = 540
+	BUFFER             = 4096
+	MAX_VALUE_SIZE     = 1000
+	CHUNK_SIZE         = 1536
+	INDEX_FANOUT       = 12
+	BLOB_WORKERS       = 8
+	MAX_BLOB_CHUNKS    = 1 << 16
+	MAX_PROVIDERS      = 20
+	MAX_PROVIDED_KEYS  = 1 << 16
+	PROVIDER_INTERVAL  = 10 * 60
+	PROVIDER_TTL       = 24 * 60 * 60
+	CACHE_TTL          = 60 * 60
+	CACHE_SIZE         = 1024
+	MAX_VALUES         = 1 << 16
+	MAX_RECORDS        = 1 << 16
+	VALUE_TTL          = 24 * 60 * 60
+	REPUBLISH_INTERVAL = 60 * 60
+	SYNC_BATCH         = 16
+	SYNC_INTERVAL      = 30
+	CHAIN_PAGE         = 64 * SYNC_BATCH
+	SEGMENT_SIZE       = 64 << 20
+	MESH_SIZE          = 6
+	MESH_MAX           = 12
+	HEARTBEAT          = 10
+	GOSSIP_FANOUT      = 3
+	GOSSIP_TTL         = 6
+	GOSSIP_SEEN_TTL    = 120
+	GOSSIP_WINDOW      = 3
+	GOSSIP_IHAVE_MAX   = 20
+	RECONCILE_LEAF     = 16
+	RECONCILE_INTERVAL = 60
+	RECONCILE_DEPTH    = 64
+	RECONCILE_BATCH    = 256
+	MAILBOX_SIZE       = 64
+	MAILBOX_MAX        = 1 << 14
+	MAILBOX_TTL        = 7 * 24 * 60 * 60
+	MAILBOX_INTERVAL   = 60
+	SUBSCRIBER_BUFFER  = 64
+	REPLY_TIMEOUT      = 5
+	MAX_MESSAGE        = 16 * BUFFER
+	QUEUE_SIZE         = 64
+	LIVENESS_INTERVAL  = 60
+	LIVENESS_FAILURES  = 3
+	ADMIN_ADDR         = "localhost:7070"
+	KEY_ITERATIONS     = 600000
+	CRAWL_WORKERS      = 8
+	CRAWL_LIMIT        = 1000
+	CRAWL_TARGETS      = 8
+	VERSION            = "0.1.0"
+	SIZE_SAMPLES       = 32
+	MIN_REPLICAS       = 3
+
+	ADMISSION_RATE           = 50
+	ADMISSION_SOURCE_RATE    = 5
+	ADMISSION_HALF_LIFE      = 30
+	ADMISSION_SOURCES        = 4096
+	ADMISSION_MAX_DIFFICULTY = 6
+	ADMISSION_WINDOW         = 60
 )
@@ -2,19 +2,27 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/ed25519"
+	"crypto/rand"
 	"crypto/sha1"
+	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"kademlia/constants"
 	"kademlia/models"
-	"kademlia/utils"
 	"log"
+	"log/slog"
 	"math/big"
 	"net"
 	"os"
 	"strings"
+	"time"
 )
 
 func GetOutboundIP() net.IP {
@@ -29,47 +37,314 @@ func GetOutboundIP() net.IP {
 	return localAddr.IP
 }
 
+func usage() {
+	fmt.Fprintln(os.Stderr, `usage: kademlia <command> [flags] [args]
+
+commands:
+  run [boot address]       run a node, bootstrapping from boot address if given
+  keygen                   generate an identity key pair
+  ping <addr|id>           ping a peer through a running node
+  lookup <id>              find the peers closest to id
+  put [value]              store value, or stdin, of any size in the DHT as
+                           a blob and print the key of its manifest
+  get <key>                print the blob whose manifest is under key
+  publish [-topic t] <msg> sign msg and publish it on the chain or a topic
+  table                    print the routing table of a running node
+  size                     print the estimated size of the network
+  crawl [-format csv] <boot address>...
+                           crawl the network from the boot addresses and
+                           print every node found as JSON or CSV
+  export [-format dot] <table|chain|topology>
+                           export the routing table, the event tree or the
+                           crawled network topology as JSON or Graphviz
+
+Run "kademlia <command> -h" for the flags of a command.`)
+}
+
 func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	command, args := os.Args[1], os.Args[2:]
+	if command == "run" {
+		run(args)
+		return
+	}
+	if command == "keygen" {
+		keygen(args)
+		return
+	}
+	if command == "crawl" {
+		crawl(args)
+		return
+	}
+	if command == "ping" || command == "lookup" || command == "put" || command == "get" || command == "publish" || command == "table" || command == "size" || command == "export" {
+		query(command, args)
+		return
+	}
+	if command != "-h" && command != "-help" && command != "help" {
+		fmt.Fprintln(os.Stderr, "unknown command "+command)
+	}
+	usage()
+	os.Exit(2)
+}
 
-	args := os.Args[1:]
+func run(args []string) {
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	logLevel := flags.String("log-level", "info", "minimum level to log: debug, info, warn or error")
+	logJSON := flags.Bool("log-json", false, "write logs as JSON lines")
+	quiet := flags.Bool("quiet", false, "disable logging")
+	bootFlag := flags.String("boot", "", "IP of the node to bootstrap from, also accepted as the first argument")
+	keyFile := flags.String("key", "priv_key.pem", "identity private key, generated if missing")
+	passphraseFile := flags.String("passphrase-file", "", "file holding the passphrase of the private key, instead of $KADEMLIA_PASSPHRASE")
+	authorizedKeys := flags.String("authorized-keys", "authorized_keys", "trusted public keys, one base64 key per line")
+	eventsDir := flags.String("events", "events", "directory of the event store")
+	adminAddr := flags.String("admin", constants.ADMIN_ADDR, "serve the admin API on this localhost address, empty to disable")
+	adminTokenFile := flags.String("admin-token", "admin_token", "file holding the admin API token, created if missing")
+	adaptive := flags.Bool("adaptive-replication", false, "store values on fewer peers while the estimated network is small")
+	metricsAddr := flags.String("metrics", "", "serve Prometheus metrics on this address, e.g. localhost:9100")
+	flags.Parse(args)
 	var server models.Server
 	var err error
 
+	if !*quiet {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+			log.Fatalf("invalid log level %v", err)
+		}
+		server.Log = models.NewLogger(os.Stderr, level, *logJSON)
+	}
+
 	addr, err := net.ResolveUDPAddr("udp", GetOutboundIP().String()+":4444")
-	utils.CheckError(err)
+	if err != nil {
+		log.Fatalf("error while resolving local address %v", err)
+	}
 	server.Addr = addr
 
-	if len(args) >= 1 {
-		addr, err := net.ResolveUDPAddr("udp", args[0]+":4444")
-		utils.CheckError(err)
+	boot := *bootFlag
+	if boot == "" && flags.NArg() >= 1 {
+		boot = flags.Arg(0)
+	}
+	if boot != "" {
+		addr, err := net.ResolveUDPAddr("udp", boot+":4444")
+		if err != nil {
+			log.Fatalf("error while resolving bootstrap address %v", err)
+		}
 		server.BootAddr = addr
 	}
 
 	server.Table = models.RoutingTable{K: 20}
-	server.Events = models.EventChain{Difficulty: 3}
 	hash := sha1.New()
 	io.WriteString(hash, server.Addr.IP.String())
 	server.ID = hex.EncodeToString(hash.Sum(nil))
 	server.Generator = big.NewInt(5)
 	server.Difficulty = 3
 	server.A = 3
-	server.PubKey = []byte{4, 30, 248, 199, 208, 99, 69, 5, 31, 162, 148, 19, 16, 254, 113, 194, 35, 64, 152, 18, 156, 84, 48, 56, 57, 59, 50, 81, 117, 79, 62, 57}
+	server.AdaptiveReplication = *adaptive
 
-	var privKey ed25519.PrivateKey
-	privKey, err = ioutil.ReadFile("priv_key.pem")
+	passphrase, err := readPassphrase(*passphraseFile)
+	if err != nil {
+		log.Fatalf("error while reading passphrase %v", err)
+	}
+	identity, created, err := models.LoadOrCreateIdentity(*keyFile, passphrase)
 	if err != nil {
 		log.Fatalf("error while reading %v", err)
 	}
+	if created {
+		fmt.Println("generated identity " + identity.ID + " in " + *keyFile)
+	}
+	server.Mail.SetIdentity(identity)
 
-	go server.Listen()
+	keys := &models.TrustStore{}
+	err = keys.LoadFile(*authorizedKeys)
+	if os.IsNotExist(err) {
+		fmt.Println("no " + *authorizedKeys + ", trusting only this node's key")
+		keys.AddIdentity(identity.ID, identity.PublicKey(), true)
+	} else if err != nil {
+		log.Fatalf("error while reading authorized keys %v", err)
+	}
+	server.Events = models.EventChain{Difficulty: 3, Keys: keys}
+	server.Events.Store, err = models.OpenEventStore(*eventsDir)
+	if err != nil {
+		log.Fatalf("error while opening event store %v", err)
+	}
+	err = server.Events.Load()
+	if err != nil {
+		log.Fatalf("error while loading events %v", err)
+	}
+
+	go printEvents(server.Subscribe(models.EventFilter{}))
+	go func() {
+		log.Fatal(server.Listen())
+	}()
+	if *adminAddr != "" {
+		token, err := adminToken(*adminTokenFile)
+		if err != nil {
+			log.Fatalf("error while reading admin token %v", err)
+		}
+		go func() {
+			log.Fatal(server.ServeAdmin(*adminAddr, token))
+		}()
+	}
+	if *metricsAddr != "" {
+		go func() {
+			log.Fatal(server.ServeMetrics(*metricsAddr))
+		}()
+	}
 	reader := bufio.NewReader(os.Stdin)
 	for {
 		fmt.Print(">> ")
-		text, _ := reader.ReadString('\n')
-		text = strings.Replace(text, "\r\n", "", -1)
-		signature := ed25519.Sign(privKey, []byte(text))
-		event := &models.Event{Data: text, Signature: signature}
-		server.Events.Append(event)
+		text, err := reader.ReadString('\n')
+		if err != nil && text == "" {
+			break
+		}
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 2 && fields[0] == "/join" {
+			if err := server.JoinTopic(fields[1]); err != nil {
+				fmt.Println(err)
+			}
+			continue
+		}
+		if len(fields) == 2 && fields[0] == "/leave" {
+			server.LeaveTopic(fields[1])
+			continue
+		}
+		if len(fields) >= 3 && fields[0] == "/pub" {
+			event := &models.Event{Topic: fields[1], Time: time.Now().Unix(), Data: strings.Join(fields[2:], " ")}
+			identity.Sign(event)
+			if err := server.Publish(event); err != nil {
+				fmt.Println(err)
+			}
+			continue
+		}
+		if len(fields) >= 3 && fields[0] == "/msg" {
+			delivered, err := server.SendDirect(fields[1], strings.Join(fields[2:], " "))
+			if err != nil {
+				fmt.Println(err)
+			} else if delivered {
+				fmt.Println("delivered")
+			} else {
+				fmt.Println(fields[1] + " is offline, message stored for later delivery")
+			}
+			continue
+		}
+		if text == "/rotate" {
+			next, err := rotateKey(&server, identity, *keyFile, passphrase)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			identity = next
+			fmt.Println("rotated the key of " + identity.ID)
+			continue
+		}
+		event, err := parseCommand(identity, text)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		if err := server.Events.Append(event); err != nil {
+			fmt.Println(err)
+			continue
+		}
 		server.Broadcast(event)
 	}
+	// Without a terminal, as under a service manager, the node keeps
+	// serving until it is stopped.
+	select {}
+}
+
+// rotateKey replaces the identity's key, publishing the rotation on the
+// chain before the new key replaces the one in path.
+func rotateKey(server *models.Server, identity *models.Identity, path string, passphrase []byte) (*models.Identity, error) {
+	next, event, err := identity.Rotate()
+	if err != nil {
+		return nil, err
+	}
+	if err := next.Save(path+".new", passphrase); err != nil {
+		return nil, err
+	}
+	if err := server.Events.Append(event); err != nil {
+		os.Remove(path + ".new")
+		return nil, err
+	}
+	server.Broadcast(event)
+	server.Mail.SetIdentity(next)
+	return next, os.Rename(path+".new", path)
+}
+
+// readPassphrase returns the private key passphrase from path, or from
+// $KADEMLIA_PASSPHRASE if path is empty. No passphrase means the key is
+// stored unencrypted.
+func readPassphrase(path string) ([]byte, error) {
+	if path == "" {
+		return []byte(os.Getenv("KADEMLIA_PASSPHRASE")), nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(data, "\r\n"), nil
+}
+
+// adminToken reads the admin API token from path, generating one readable
+// only by the current user if the file doesn't exist yet.
+func adminToken(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		return strings.TrimSpace(string(data)), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+	return token, ioutil.WriteFile(path, []byte(token+"\n"), 0600)
+}
+
+func printEvents(events <-chan models.Event) {
+	for event := range events {
+		if event.Kind == "direct" {
+			fmt.Println("\n[dm] "+event.Author, event.Data)
+		} else if event.Topic != "" {
+			fmt.Println("\n["+event.Topic+"] "+event.Author, event.Data)
+		} else if event.Kind == "" {
+			fmt.Println("\n"+event.Author, event.Data)
+		} else {
+			continue
+		}
+		fmt.Print(">> ")
+	}
+}
+
+func parseCommand(identity *models.Identity, text string) (*models.Event, error) {
+	fields := strings.Fields(text)
+	if len(fields) >= 2 && fields[0] == "/trust" {
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, errors.New("usage: /trust <base64 public key> [admin]")
+		}
+		update := models.TrustUpdate{Op: "add", Key: key, Admin: len(fields) > 2 && fields[2] == "admin"}
+		data, err := json.Marshal(update)
+		if err != nil {
+			return nil, err
+		}
+		return identity.SignEvent("trust", string(data)), nil
+	}
+	if len(fields) == 2 && fields[0] == "/revoke" {
+		data, err := json.Marshal(models.TrustUpdate{Op: "remove", ID: fields[1]})
+		if err != nil {
+			return nil, err
+		}
+		return identity.SignEvent("trust", string(data)), nil
+	}
+	return identity.SignEvent("", text), nil
 }
@@ -0,0 +1,499 @@
+package models
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"kademlia/constants"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PeerInfo is how the admin API shows a peer, without the session keys and
+// tree links Peer carries.
+type PeerInfo struct {
+	ID         string        `json:"id"`
+	Addr       string        `json:"address"`
+	Difficulty int           `json:"difficulty"`
+	LastSeen   time.Time     `json:"last_seen"`
+	RTT        time.Duration `json:"rtt"`
+}
+
+type BucketInfo struct {
+	Root  string     `json:"root"`
+	Min   string     `json:"min"`
+	Max   string     `json:"max"`
+	K     int        `json:"k"`
+	Peers []PeerInfo `json:"peers"`
+}
+
+type NodeConfig struct {
+	ID              string   `json:"id"`
+	Addr            string   `json:"address"`
+	BootAddr        string   `json:"boot_address,omitempty"`
+	Difficulty      int      `json:"difficulty"`
+	ChainDifficulty int      `json:"chain_difficulty"`
+	Alpha           int      `json:"alpha"`
+	K               int      `json:"k"`
+	Adaptive        bool     `json:"adaptive_replication"`
+	Topics          []string `json:"topics"`
+}
+
+type Blacklist struct {
+	mu  sync.Mutex
+	ids map[string]bool
+}
+
+func (b *Blacklist) Add(id string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.ids == nil {
+		b.ids = make(map[string]bool)
+	}
+	b.ids[id] = true
+}
+
+func (b *Blacklist) Remove(id string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.ids, id)
+}
+
+func (b *Blacklist) Contains(id string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.ids[id]
+}
+
+func (b *Blacklist) List() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ids := []string{}
+	for id := range b.ids {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+type PingResult struct {
+	ID    string        `json:"id"`
+	Alive bool          `json:"alive"`
+	RTT   time.Duration `json:"rtt"`
+}
+
+func (p *Peer) Info() PeerInfo {
+	lastSeen, rtt := p.Stats()
+	info := PeerInfo{ID: p.ID, Difficulty: p.difficulty(), LastSeen: lastSeen, RTT: rtt}
+	if p.Addr != nil {
+		info.Addr = p.Addr.String()
+	}
+	return info
+}
+
+func peerInfos(peers []*Peer) []PeerInfo {
+	infos := []PeerInfo{}
+	for _, peer := range peers {
+		infos = append(infos, peer.Info())
+	}
+	return infos
+}
+
+func (s *Server) Config() NodeConfig {
+	config := NodeConfig{
+		ID:              s.ID,
+		Difficulty:      s.Admission.Required("", s.Difficulty),
+		ChainDifficulty: s.Events.Difficulty,
+		Alpha:           s.A,
+		K:               s.Table.K,
+		Adaptive:        s.AdaptiveReplication,
+		Topics:          s.Topics.Topics(),
+	}
+	if s.Addr != nil {
+		config.Addr = s.Addr.String()
+	}
+	if s.BootAddr != nil {
+		config.BootAddr = s.BootAddr.String()
+	}
+	return config
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// targetPeer resolves the peer named by the id or addr query parameter: a
+// node ID from the routing table or lookup, or an IP with optional port.
+func (s *Server) targetPeer(r *http.Request) (*Peer, error) {
+	if id := r.URL.Query().Get("id"); id != "" {
+		if !ValidID(id) {
+			return nil, fmt.Errorf("%w: invalid node id", ErrMalformed)
+		}
+		if peer := s.findPeer(id); peer != nil {
+			return peer, nil
+		}
+		return nil, ErrNotFound
+	}
+	addr := r.URL.Query().Get("addr")
+	if addr == "" {
+		return nil, errors.New("id or addr is required")
+	}
+	if !strings.Contains(addr, ":") {
+		addr += ":4444"
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if peer := s.Table.FindPeer(NodeID(udpAddr.IP)); peer != nil {
+		return peer, nil
+	}
+	return Tuple{Addr: udpAddr, Difficulty: 3}.AsPeer(), nil
+}
+
+func (s *Server) adminTable(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.ExportTable().Buckets)
+}
+
+func (s *Server) adminPeers(w http.ResponseWriter, r *http.Request) {
+	var peers []*Peer
+	if !s.Table.Empty() {
+		peers = s.Table.ListPeers()
+	}
+	writeJSON(w, http.StatusOK, peerInfos(peers))
+}
+
+// adminChain returns the canonical events between the from and to heights,
+// defaulting to the last SYNC_BATCH events and returning at most CHAIN_PAGE.
+func (s *Server) adminChain(w http.ResponseWriter, r *http.Request) {
+	to := s.Events.Len() - 1
+	from := to - constants.SYNC_BATCH + 1
+	var err error
+	if value := r.URL.Query().Get("from"); value != "" {
+		if from, err = strconv.Atoi(value); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	if value := r.URL.Query().Get("to"); value != "" {
+		if to, err = strconv.Atoi(value); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	if from < 0 && r.URL.Query().Get("from") == "" {
+		from = 0
+	}
+	if from < 0 || to < from {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("%w: invalid range %d to %d", ErrMalformed, from, to))
+		return
+	}
+	if to-from >= constants.CHAIN_PAGE {
+		to = from + constants.CHAIN_PAGE - 1
+	}
+	events := s.Events.Range(from, to)
+	if events == nil {
+		events = []*Event{}
+	}
+	writeJSON(w, http.StatusOK, events)
+}
+
+func (s *Server) adminLookup(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if !ValidKey(id) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("%w: invalid id", ErrMalformed))
+		return
+	}
+	writeJSON(w, http.StatusOK, peerInfos(s.Lookup(id)))
+}
+
+// adminValues gets the value under the key parameter, or stores the request
+// body, at most CHUNK_SIZE bytes, and answers with its key. Larger values
+// go through adminBlobs.
+func (s *Server) adminValues(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		value, err := io.ReadAll(io.LimitReader(r.Body, constants.CHUNK_SIZE+1))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		key, err := s.Put(value)
+		if errors.Is(err, ErrValueTooBig) {
+			writeError(w, http.StatusRequestEntityTooLarge, err)
+			return
+		}
+		if err != nil && key == "" {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		response := map[string]string{"key": key}
+		if err != nil {
+			response["warning"] = err.Error()
+		}
+		writeJSON(w, http.StatusOK, response)
+		return
+	}
+	key := r.URL.Query().Get("key")
+	if !ValidKey(key) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("%w: invalid key", ErrMalformed))
+		return
+	}
+	value, err := s.Get(key)
+	if errors.Is(err, ErrNotFound) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(value)
+}
+
+// adminBlobs gets the blob whose manifest is under the key parameter, or
+// stores the request body as a blob and answers with the key of its
+// manifest.
+func (s *Server) adminBlobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		data, err := io.ReadAll(io.LimitReader(r.Body, constants.MAX_BLOB_CHUNKS*constants.CHUNK_SIZE+1))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		key, err := s.PutBlob(data)
+		if errors.Is(err, ErrValueTooBig) {
+			writeError(w, http.StatusRequestEntityTooLarge, err)
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"key": key})
+		return
+	}
+	key := r.URL.Query().Get("key")
+	if !ValidKey(key) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("%w: invalid key", ErrMalformed))
+		return
+	}
+	blob, err := s.GetBlob(key)
+	if errors.Is(err, ErrNotFound) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if errors.Is(err, ErrMalformed) {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(blob)
+}
+
+func (s *Server) adminPing(w http.ResponseWriter, r *http.Request) {
+	peer, err := s.targetPeer(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	alive := peer.Ping()
+	_, rtt := peer.Stats()
+	writeJSON(w, http.StatusOK, PingResult{ID: peer.ID, Alive: alive, RTT: rtt})
+}
+
+// adminBlacklist blocks or unblocks a peer. A blacklisted peer is dropped
+// from the routing table and its key exchanges are refused.
+func (s *Server) adminBlacklist(blacklist bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		peer, err := s.targetPeer(r)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		id := r.URL.Query().Get("id")
+		if peer != nil {
+			id = peer.ID
+		}
+		if blacklist {
+			s.Blacklist.Add(id)
+			if removed := s.Table.RemovePeer(id); removed != nil {
+				s.peerLeft(removed)
+			}
+		} else {
+			s.Blacklist.Remove(id)
+		}
+		s.logger("admin").Info("updated blacklist", "peer", id, "blacklisted", blacklist)
+		writeJSON(w, http.StatusOK, s.Blacklist.List())
+	}
+}
+
+func (s *Server) adminBlacklisted(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.Blacklist.List())
+}
+
+// adminEvents appends a signed event to the chain and broadcasts it, or
+// publishes it when it has a topic.
+func (s *Server) adminEvents(w http.ResponseWriter, r *http.Request) {
+	var event Event
+	if err := json.NewDecoder(io.LimitReader(r.Body, constants.MAX_VALUE_SIZE*4)).Decode(&event); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("%w: %v", ErrMalformed, err))
+		return
+	}
+	if event.Author == "" || len(event.Signature) == 0 {
+		writeError(w, http.StatusBadRequest, errors.New("event is not signed"))
+		return
+	}
+	if err := s.Events.Keys.Verify(&event); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if event.Topic != "" {
+		if err := s.Publish(&event); err != nil {
+			writeError(w, http.StatusServiceUnavailable, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, event)
+		return
+	}
+	if err := s.Events.Append(&event); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	s.Broadcast(&event)
+	writeJSON(w, http.StatusOK, event)
+}
+
+// adminExport exports the routing table, the event tree or, by crawling the
+// network, its topology, as JSON or with format=dot as a Graphviz graph. A
+// topology can also be exported as CSV.
+func (s *Server) adminExport(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "dot" && format != "csv" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unknown format %q", format))
+		return
+	}
+	var export interface{}
+	var dot func(io.Writer)
+	what := strings.TrimPrefix(r.URL.Path, "/export/")
+	if what == "table" {
+		table := s.ExportTable()
+		export, dot = table, func(w io.Writer) { WriteTableDOT(w, table) }
+	} else if what == "chain" {
+		tree := s.Events.Tree()
+		export, dot = tree, func(w io.Writer) { WriteChainDOT(w, tree) }
+	} else if what == "topology" {
+		limit := constants.CRAWL_LIMIT
+		if value := r.URL.Query().Get("limit"); value != "" {
+			var err error
+			if limit, err = strconv.Atoi(value); err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+		}
+		topology := s.Crawl(limit)
+		if format == "csv" {
+			w.Header().Set("Content-Type", "text/csv")
+			WriteCrawlCSV(w, topology)
+			return
+		}
+		export, dot = topology, func(w io.Writer) { WriteTopologyDOT(w, topology) }
+	} else {
+		writeError(w, http.StatusNotFound, fmt.Errorf("nothing to export at %s", r.URL.Path))
+		return
+	}
+	if format == "csv" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("only the topology can be exported as csv"))
+		return
+	}
+	if format == "dot" {
+		w.Header().Set("Content-Type", "text/vnd.graphviz")
+		dot(w)
+		return
+	}
+	writeJSON(w, http.StatusOK, export)
+}
+
+func (s *Server) adminSize(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.NetworkSize())
+}
+
+func (s *Server) adminConfig(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.Config())
+}
+
+// method restricts handler to requests using one of methods.
+func method(handler http.HandlerFunc, methods ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, m := range methods {
+			if r.Method == m {
+				handler(w, r)
+				return
+			}
+		}
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+// AdminHandler serves the admin API. Every request must carry token as a
+// bearer token.
+func (s *Server) AdminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/table", method(s.adminTable, http.MethodGet))
+	mux.HandleFunc("/peers", method(s.adminPeers, http.MethodGet))
+	mux.HandleFunc("/chain", method(s.adminChain, http.MethodGet))
+	mux.HandleFunc("/events", method(s.adminEvents, http.MethodPost))
+	mux.HandleFunc("/lookup", method(s.adminLookup, http.MethodGet))
+	mux.HandleFunc("/values", method(s.adminValues, http.MethodGet, http.MethodPost))
+	mux.HandleFunc("/blobs", method(s.adminBlobs, http.MethodGet, http.MethodPost))
+	mux.HandleFunc("/ping", method(s.adminPing, http.MethodPost))
+	mux.HandleFunc("/blacklisted", method(s.adminBlacklisted, http.MethodGet))
+	mux.HandleFunc("/blacklist", method(s.adminBlacklist(true), http.MethodPost))
+	mux.HandleFunc("/unblacklist", method(s.adminBlacklist(false), http.MethodPost))
+	mux.HandleFunc("/config", method(s.adminConfig, http.MethodGet))
+	mux.HandleFunc("/size", method(s.adminSize, http.MethodGet))
+	mux.HandleFunc("/export/", method(s.adminExport, http.MethodGet))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("invalid admin token"))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// ServeAdmin serves the admin API on addr, which must be a loopback
+// address.
+func (s *Server) ServeAdmin(addr string, token string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("admin API must listen on localhost, not %s", host)
+	}
+	if token == "" {
+		return errors.New("admin API requires a token")
+	}
+	s.logger("admin").Info("serving admin API", "addr", addr)
+	return http.ListenAndServe(addr, s.AdminHandler(token))
+}
@@ -0,0 +1,94 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"kademlia/constants"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminEventsVerifies(t *testing.T) {
+	s := newTestServer("127.0.0.1")
+	trusted, _ := NewIdentity()
+	s.Events = EventChain{Difficulty: 1, Keys: &TrustStore{}}
+	s.Events.Keys.AddIdentity(trusted.ID, trusted.PublicKey(), false)
+
+	post := func(event *Event) int {
+		body, _ := json.Marshal(event)
+		w := httptest.NewRecorder()
+		s.adminEvents(w, httptest.NewRequest(http.MethodPost, "/events", bytes.NewReader(body)))
+		return w.Code
+	}
+	stranger, _ := NewIdentity()
+	if code := post(stranger.SignEvent("", "hello")); code != http.StatusBadRequest {
+		t.Fatalf("event from an unknown author got %d", code)
+	}
+	forged := trusted.SignEvent("", "hello")
+	forged.Data = "goodbye"
+	if code := post(forged); code != http.StatusBadRequest {
+		t.Fatalf("event with a bad signature got %d", code)
+	}
+	if s.Events.Len() != 0 {
+		t.Fatal("rejected events were appended")
+	}
+	if code := post(trusted.SignEvent("", "hello")); code != http.StatusOK || s.Events.Len() != 1 {
+		t.Fatalf("signed event got %d", code)
+	}
+}
+
+func TestAdminBlobs(t *testing.T) {
+	s := newTestServer("127.0.0.1")
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+
+	w := httptest.NewRecorder()
+	s.adminValues(w, httptest.NewRequest(http.MethodPost, "/values", bytes.NewReader(data)))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("storing %d bytes as a value got %d", len(data), w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	s.adminBlobs(w, httptest.NewRequest(http.MethodPost, "/blobs", bytes.NewReader(data)))
+	var result map[string]string
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &result) != nil {
+		t.Fatalf("storing a blob got %d: %s", w.Code, w.Body)
+	}
+	w = httptest.NewRecorder()
+	s.adminBlobs(w, httptest.NewRequest(http.MethodGet, "/blobs?key="+result["key"], nil))
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), data) {
+		t.Fatalf("fetching the blob got %d with %d bytes", w.Code, w.Body.Len())
+	}
+}
+
+func TestAdminChainRange(t *testing.T) {
+	s := newTestServer("127.0.0.1")
+	identity, _ := NewIdentity()
+	s.Events = EventChain{Difficulty: 1, Keys: &TrustStore{}}
+	s.Events.Keys.AddIdentity(identity.ID, identity.PublicKey(), false)
+	for i := 0; i < constants.CHAIN_PAGE+2; i++ {
+		if err := s.Events.Append(identity.SignEvent("", fmt.Sprint("event ", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	get := func(query string) ([]*Event, int) {
+		w := httptest.NewRecorder()
+		s.adminChain(w, httptest.NewRequest(http.MethodGet, "/chain?"+query, nil))
+		var events []*Event
+		json.Unmarshal(w.Body.Bytes(), &events)
+		return events, w.Code
+	}
+	for _, query := range []string{"from=-1", "from=5&to=4", "to=-2"} {
+		if _, code := get(query); code != http.StatusBadRequest {
+			t.Fatalf("%s got %d", query, code)
+		}
+	}
+	events, code := get("from=0&to=1000000000")
+	if code != http.StatusOK || len(events) != constants.CHAIN_PAGE {
+		t.Fatalf("a range past CHAIN_PAGE got %d with %d events", code, len(events))
+	}
+	if events, _ := get(""); len(events) != constants.SYNC_BATCH {
+		t.Fatalf("the default range holds %d events", len(events))
+	}
+}
@@ -0,0 +1,134 @@
+package models
+
+import (
+	"kademlia/constants"
+	"math"
+	"sync"
+	"time"
+)
+
+// decaying is a count that halves every ADMISSION_HALF_LIFE seconds.
+type decaying struct {
+	value float64
+	at    time.Time
+}
+
+func (d *decaying) get(now time.Time) float64 {
+	if d.at.IsZero() {
+		return 0
+	}
+	elapsed := now.Sub(d.at).Seconds()
+	return d.value * math.Exp2(-elapsed/constants.ADMISSION_HALF_LIFE)
+}
+
+func (d *decaying) add(now time.Time, n float64) {
+	d.value = d.get(now) + n
+	d.at = now
+}
+
+// rate converts a decaying count into events per second, which it tends to
+// when events arrive at a steady rate.
+func (d *decaying) rate(now time.Time) float64 {
+	return d.get(now) * math.Ln2 / constants.ADMISSION_HALF_LIFE
+}
+
+type source struct {
+	requests decaying
+	failures decaying
+}
+
+// seen is when the source last sent anything.
+func (src *source) seen() time.Time {
+	if src.failures.at.After(src.requests.at) {
+		return src.failures.at
+	}
+	return src.requests.at
+}
+
+// Admission tracks how many handshakes arrive, overall and per source, and
+// how often a source sent something invalid. The proof of work it requires
+// rises with both and decays back as they calm down.
+type Admission struct {
+	mu      sync.Mutex
+	total   decaying
+	sources map[string]*source
+}
+
+func (a *Admission) source(id string) *source {
+	if a.sources == nil {
+		a.sources = make(map[string]*source)
+	}
+	src, ok := a.sources[id]
+	if !ok {
+		if len(a.sources) >= constants.ADMISSION_SOURCES {
+			a.prune(time.Now())
+		}
+		src = &source{}
+		a.sources[id] = src
+	}
+	return src
+}
+
+// prune forgets sources whose counts have decayed away or, if none have,
+// the one heard from least recently.
+func (a *Admission) prune(now time.Time) {
+	oldest, last := "", now
+	for id, src := range a.sources {
+		if src.requests.get(now) < 0.01 && src.failures.get(now) < 0.01 {
+			delete(a.sources, id)
+			continue
+		}
+		if seen := src.seen(); oldest == "" || seen.Before(last) {
+			oldest, last = id, seen
+		}
+	}
+	if len(a.sources) >= constants.ADMISSION_SOURCES {
+		delete(a.sources, oldest)
+	}
+}
+
+// Request records a handshake from id.
+func (a *Admission) Request(id string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	a.total.add(now, 1)
+	a.source(id).requests.add(now, 1)
+}
+
+// Failure records that id sent something invalid.
+func (a *Admission) Failure(id string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.source(id).failures.add(time.Now(), 1)
+}
+
+// doublings is how many times value doubled past limit, rounded up.
+func doublings(value float64, limit float64) int {
+	if value <= limit {
+		return 0
+	}
+	return int(math.Ceil(math.Log2(value / limit)))
+}
+
+// Required is the difficulty a handshake from id must meet: base, plus one
+// for every doubling of the overall rate past ADMISSION_RATE and of id's
+// rate past ADMISSION_SOURCE_RATE, plus one for every doubling, rounded, of
+// id's recent failures. An empty id gives the difficulty any newcomer faces.
+func (a *Admission) Required(id string, base int) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	difficulty := base + doublings(a.total.rate(now), constants.ADMISSION_RATE)
+	if src, ok := a.sources[id]; ok {
+		difficulty += doublings(src.requests.rate(now), constants.ADMISSION_SOURCE_RATE)
+		difficulty += int(math.Round(math.Log2(1 + src.failures.get(now))))
+	}
+	if difficulty > constants.ADMISSION_MAX_DIFFICULTY {
+		difficulty = constants.ADMISSION_MAX_DIFFICULTY
+	}
+	if difficulty < base {
+		difficulty = base
+	}
+	return difficulty
+}
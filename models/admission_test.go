@@ -0,0 +1,182 @@
+package models
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kademlia/constants"
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDecayingHalves(t *testing.T) {
+	start := time.Now()
+	d := decaying{}
+	d.add(start, 8)
+	later := start.Add(constants.ADMISSION_HALF_LIFE * time.Second)
+	if got := d.get(later); math.Abs(got-4) > 1e-9 {
+		t.Fatalf("after one half-life got %v, want 4", got)
+	}
+	d.add(later, 4)
+	if got := d.get(later.Add(2 * constants.ADMISSION_HALF_LIFE * time.Second)); math.Abs(got-2) > 1e-9 {
+		t.Fatalf("after two more half-lives got %v, want 2", got)
+	}
+}
+
+func TestRequired(t *testing.T) {
+	var a Admission
+	if got := a.Required("newcomer", 3); got != 3 {
+		t.Fatalf("unknown source faces %d, want the base 3", got)
+	}
+
+	a.Failure("bad")
+	if got := a.Required("bad", 3); got != 4 {
+		t.Fatalf("one failure gives %d, want 4", got)
+	}
+	a.Failure("bad")
+	a.Failure("bad")
+	if got := a.Required("bad", 3); got != 5 {
+		t.Fatalf("three failures give %d, want 5", got)
+	}
+	for i := 0; i < 100; i++ {
+		a.Failure("bad")
+	}
+	if got := a.Required("bad", 3); got != constants.ADMISSION_MAX_DIFFICULTY {
+		t.Fatalf("many failures give %d, want the cap %d", got, constants.ADMISSION_MAX_DIFFICULTY)
+	}
+	if got := a.Required("good", 3); got != 3 {
+		t.Fatalf("another source faces %d, want 3", got)
+	}
+
+	// A steady stream from one source raises only that source's difficulty.
+	for i := 0; i < 2*constants.ADMISSION_SOURCE_RATE*constants.ADMISSION_HALF_LIFE; i++ {
+		a.Request("busy")
+	}
+	if got := a.Required("busy", 3); got <= 3 {
+		t.Fatalf("busy source faces %d, want more than 3", got)
+	}
+	if got := a.Required("", 3); got != 3 {
+		t.Fatalf("newcomers face %d, want 3", got)
+	}
+}
+
+func TestRequiredDecays(t *testing.T) {
+	var a Admission
+	for i := 0; i < 7; i++ {
+		a.Failure("bad")
+	}
+	a.sources["bad"].failures.at = time.Now().Add(-10 * constants.ADMISSION_HALF_LIFE * time.Second)
+	if got := a.Required("bad", 3); got != 3 {
+		t.Fatalf("decayed failures give %d, want 3", got)
+	}
+}
+
+// TestFaultAttribution checks that only faults after a key exchange count
+// against the sender.
+func TestFaultAttribution(t *testing.T) {
+	s := newTestServer("127.0.0.1")
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.5"), Port: 4444}
+	id := NodeID(addr.IP)
+	for _, err := range []error{ErrKeyExchange, ErrMalformed, ErrTimeout, ErrPowFailed} {
+		s.drop(addr, err)
+	}
+	if got := s.Admission.Required(id, 3); got != 3 {
+		t.Fatalf("drops raised the difficulty to %d", got)
+	}
+	s.fault(addr, ErrMalformed)
+	if got := s.Admission.Required(id, 3); got != 4 {
+		t.Fatalf("a fault gives %d, want 4", got)
+	}
+}
+
+// TestOfferRetry has a server demand more work than a client offers; the
+// client must retry at the demanded difficulty and keep using it.
+func TestOfferRetry(t *testing.T) {
+	s := startTestServer(t, "127.0.0.1")
+	s.Admission.Failure(NodeID(s.Addr.IP))
+	peer := testPeer(s)
+	if peer.Difficulty != 3 {
+		t.Fatalf("server advertises %d", peer.Difficulty)
+	}
+	if !peer.Ping() {
+		t.Fatal("ping failed")
+	}
+	if got := peer.difficulty(); got != 4 {
+		t.Fatalf("client now mines at %d, want 4", got)
+	}
+	drops := s.Drops.Counts()
+	if drops[ErrPowFailed.Error()] != 1 {
+		t.Fatalf("drops %v, want the first offer dropped for its work", drops)
+	}
+	if errors.Is(s.Drops.Last, ErrMalformed) {
+		t.Fatalf("unexpected drop %v", s.Drops.Last)
+	}
+}
+
+func TestAdmissionSourcesCapped(t *testing.T) {
+	var a Admission
+	for i := 0; i < constants.ADMISSION_SOURCES; i++ {
+		a.Request(fmt.Sprint("source ", i))
+	}
+	a.sources["source 7"].requests.at = time.Now().Add(-time.Second)
+	a.Request("newcomer")
+	if len(a.sources) != constants.ADMISSION_SOURCES {
+		t.Fatalf("tracking %d sources, want at most %d", len(a.sources), constants.ADMISSION_SOURCES)
+	}
+	if _, ok := a.sources["source 7"]; ok {
+		t.Fatal("least recently seen source kept")
+	}
+	if _, ok := a.sources["newcomer"]; !ok {
+		t.Fatal("newcomer not tracked")
+	}
+}
+
+// TestStaleProof checks that the server refuses a proof of work mined
+// longer than ADMISSION_WINDOW ago, and that a client reuses its fresh one.
+func TestStaleProof(t *testing.T) {
+	s := startTestServer(t, "127.0.0.1")
+	peer := testPeer(s)
+	if !peer.Ping() {
+		t.Fatal("ping failed")
+	}
+	pow := peer.pow
+	if !peer.Ping() || peer.pow != pow {
+		t.Fatal("fresh proof of work not reused")
+	}
+
+	offer := func(at int64) KeyOffer {
+		t.Helper()
+		ss, err := peer.newSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		nonce := peer.calculateNonce(challenge(peer.ID, ss.pubKey, at), peer.difficulty())
+		conn, err := net.DialUDP("udp", nil, s.Addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		data, _ := json.Marshal(KeyOffer{Type: "key exchange", Nonce: nonce, Time: at, Prime: ss.prime, Key: ss.pubKey})
+		conn.Write(append([]byte(base64.StdEncoding.EncodeToString(data)), 4))
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		msg, _, err := readMessage(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var reply KeyOffer
+		raw, _ := base64.StdEncoding.DecodeString(msg)
+		if err := json.Unmarshal(raw, &reply); err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+	if reply := offer(time.Now().Unix() - constants.ADMISSION_WINDOW - 1); reply.Type != "difficulty" {
+		t.Fatalf("stale proof accepted: %+v", reply)
+	}
+	if reply := offer(time.Now().Unix()); reply.Type == "difficulty" || reply.Key == nil {
+		t.Fatalf("fresh proof refused: %+v", reply)
+	}
+}
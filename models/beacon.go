@@ -1,22 +1,21 @@
 package models
 
 import (
-	"crypto/ed25519"
+	"crypto/rand"
 	"crypto/sha1"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/binary"
-	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github/briansmith33/kademlia/constants"
 	"io"
+	"kademlia/constants"
 	"kademlia/utils"
+	"log/slog"
 	"math/big"
-	"math/rand"
 	"net"
 	"strconv"
-	"strings"
 	"time"
 )
 
@@ -26,19 +25,32 @@ type Server struct {
 	BootAddr   *net.UDPAddr
 	Table      RoutingTable
 	Events     EventChain
+	Values     ValueStore
+	Topics     PubSub
+	Gossip     Gossip
+	Mail       Mailbox
+	Notify     Notifier
+	Drops      Drops
+	Blacklist  Blacklist
+	Size       SizeEstimator
+	Admission  Admission
+	Log        *slog.Logger
+	queue      []datagram
 	ID         string
-	PubKey     ed25519.PublicKey
 	Comm       bool
 	Generator  *big.Int
 	Difficulty int
 	A          int
+
+	AdaptiveReplication bool
 }
 
-func (s *Server) generatePrivateKey() *big.Int {
+func (s *Server) generatePrivateKey() (*big.Int, error) {
 	priv_key := make([]byte, constants.KEY_LENGTH)
-	_, err := rand.Read(priv_key)
-	utils.CheckError(err)
-	return new(big.Int).SetBytes(priv_key)
+	if _, err := rand.Read(priv_key); err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(priv_key), nil
 }
 
 func (s *Server) generatePublicKey(prime *big.Int, privKey *big.Int) *big.Int {
@@ -56,93 +68,147 @@ func (s *Server) getKey(prime *big.Int, privKey *big.Int, remote_pub_key *big.In
 	return md
 }
 
+// AsTuple advertises this node with the difficulty a newcomer must meet.
 func (s *Server) AsTuple() Tuple {
-	return Tuple{Addr: s.Addr, Difficulty: s.Difficulty}
+	return Tuple{Addr: s.Addr, Difficulty: s.Admission.Required("", s.Difficulty)}
 }
 
-func (s *Server) GetKey() []byte {
-	var msg string
-	var addr net.Addr
-	for {
-		chunk := make([]byte, constants.BUFFER)
-		var err error
-		_, addr, err = s.Conn.ReadFromUDP(chunk)
-		utils.CheckError(err)
-		msg += strings.TrimSpace(string(chunk))
-		if strings.Contains(msg, string(4)) {
-			break
+// challenge is what a client proves work for: the server's ID, the key it
+// offers and when it mined the proof.
+func challenge(id string, key *big.Int, at int64) string {
+	return id + key.Text(16) + strconv.FormatInt(at, 10)
+}
+
+// fresh reports whether a proof of work mined at is within
+// ADMISSION_WINDOW seconds of now.
+func fresh(at int64, now time.Time) bool {
+	return at >= now.Unix()-constants.ADMISSION_WINDOW && at <= now.Unix()+constants.ADMISSION_WINDOW
+}
+
+// meetsDifficulty reports whether the offer carries a proof of work for id
+// at the required difficulty or any harder one, so that clients that still
+// mine for a difficulty that has since decayed are admitted.
+func meetsDifficulty(id string, offer KeyOffer, required int) bool {
+	hash := sha1.New()
+	io.WriteString(hash, challenge(id, offer.Key, offer.Time)+strconv.Itoa(offer.Nonce))
+	h := binary.BigEndian.Uint64(hash.Sum(nil))
+	for difficulty := required; difficulty == required || difficulty <= constants.ADMISSION_MAX_DIFFICULTY; difficulty++ {
+		minInt, maxInt := utils.GetTargetRange(len(id), difficulty)
+		if minInt < h && h < maxInt {
+			return true
 		}
 	}
+	return false
+}
+
+// datagram is a message read from one sender while waiting for another.
+type datagram struct {
+	msg  string
+	addr *net.UDPAddr
+}
 
-	msg = strings.Replace(msg, string(4), "", -1)
-	message, _ := base64.StdEncoding.DecodeString(msg)
+// next returns the oldest requeued datagram, or reads a new one.
+func (s *Server) next() (string, *net.UDPAddr, error) {
+	if len(s.queue) > 0 {
+		d := s.queue[0]
+		s.queue = s.queue[1:]
+		return d.msg, d.addr, nil
+	}
+	return readMessage(s.Conn)
+}
+
+func (s *Server) GetKey() ([]byte, *net.UDPAddr, error) {
+	msg, addr, err := s.next()
+	if err != nil {
+		return nil, addr, err
+	}
+	message, err := base64.StdEncoding.DecodeString(msg)
+	if err != nil {
+		return nil, addr, fmt.Errorf("%w: %v", ErrKeyExchange, err)
+	}
 	var offer KeyOffer
-	err := json.Unmarshal(message, &offer)
-	utils.CheckError(err)
-	if offer.Type == "key exchange" && offer.Prime.BitLen() == 2048 {
-		hash := sha1.New()
-		io.WriteString(hash, addr.(*net.UDPAddr).IP.String())
-		peerID := hex.EncodeToString(hash.Sum(nil))
-		peer := s.Table.FindPeer(peerID)
-		if peer == nil {
-
-			peer = &Peer{
-				ID:         peerID,
-				Addr:       addr.(*net.UDPAddr),
-				Difficulty: 3,
-				Generator:  big.NewInt(5),
-			}
-		}
+	if err := decode(message, &offer); err != nil {
+		return nil, addr, fmt.Errorf("%w: %w", ErrKeyExchange, err)
+	}
+	if offer.Type != "key exchange" || offer.Prime == nil || offer.Prime.BitLen() != 2048 || offer.Key == nil || offer.Key.Sign() <= 0 {
+		return nil, addr, fmt.Errorf("%w: invalid offer", ErrKeyExchange)
+	}
+	peerID := NodeID(addr.IP)
+	if s.Blacklist.Contains(peerID) {
+		return nil, addr, ErrBlacklisted
+	}
+	s.Admission.Request(peerID)
+	required := s.Admission.Required(peerID, s.Difficulty)
+	if !fresh(offer.Time, time.Now()) || !meetsDifficulty(s.ID, offer, required) {
+		s.sendOffer(addr, KeyOffer{Type: "difficulty", Difficulty: required})
+		return nil, addr, ErrPowFailed
+	}
+	privKey, err := s.generatePrivateKey()
+	if err != nil {
+		return nil, addr, err
+	}
+	pubKey := s.generatePublicKey(offer.Prime, privKey)
+	if err := s.sendOffer(addr, KeyOffer{Key: pubKey, Difficulty: required}); err != nil {
+		return nil, addr, err
+	}
+	return s.getKey(offer.Prime, privKey, offer.Key), addr, nil
+}
 
-		minInt, maxInt := utils.GetTargetRange(len(s.ID), peer.Difficulty)
-		hash = sha1.New()
-		io.WriteString(hash, s.ID+strconv.Itoa(offer.Nonce))
-		h := binary.BigEndian.Uint64(hash.Sum(nil))
-		if minInt < h && h < maxInt {
-			privKey := s.generatePrivateKey()
-			pubKey := s.generatePublicKey(offer.Prime, privKey)
-			response := KeyOffer{Key: pubKey}
-			data, err := json.Marshal(response)
-			utils.CheckError(err)
-			b64 := base64.StdEncoding.EncodeToString(data)
-			s.Conn.WriteTo([]byte(b64)+[]byte{4}, addr)
-			return s.getKey(offer.Prime, privKey, offer.Key)
-		}
+func (s *Server) sendOffer(addr *net.UDPAddr, offer KeyOffer) error {
+	data, err := json.Marshal(offer)
+	if err != nil {
+		return err
 	}
-	return nil
+	b64 := base64.StdEncoding.EncodeToString(data)
+	_, err = s.Conn.WriteTo(append([]byte(b64), 4), addr)
+	return err
 }
 
-func (s *Server) Send(addr *net.UDPAddr, key []byte, msgType string, msgData []byte) {
+func (s *Server) Send(addr *net.UDPAddr, key []byte, msgType string, msgData []byte) error {
 	msg := Msg{Type: msgType, Data: msgData}
 	marshalledMsg, err := json.Marshal(msg)
-	utils.CheckError(err)
-	encrypted_data := utils.Encrypt(marshalledMsg, key)
-	s.Conn.WriteTo([]byte(encrypted_data)+[]byte{4}, addr)
+	if err != nil {
+		return err
+	}
+	encrypted_data, err := utils.Encrypt(marshalledMsg, key)
+	if err != nil {
+		return err
+	}
+	_, err = s.Conn.WriteTo(append([]byte(encrypted_data), 4), addr)
+	return err
 }
 
-func (s *Server) Receive(key []byte) (string, []byte, *net.UDPAddr, error) {
-	var msg string
-	var addr net.Addr
-	var err error
+// Receive reads the message that follows a key exchange with from.
+// Datagrams from other senders are requeued for GetKey. It waits at most
+// REPLY_TIMEOUT so a peer that never sends one can't stall the server.
+func (s *Server) Receive(key []byte, from *net.UDPAddr) (Msg, error) {
+	s.Conn.SetReadDeadline(time.Now().Add(constants.REPLY_TIMEOUT * time.Second))
+	defer s.Conn.SetReadDeadline(time.Time{})
 	for {
-		chunk := make([]byte, constants.BUFFER)
-		_, addr, err = s.Conn.ReadFromUDP(chunk)
-		msg += strings.TrimSpace(string(chunk))
-		if strings.Contains(msg, string(4)) {
-			break
+		msg, addr, err := readMessage(s.Conn)
+		if err != nil {
+			return Msg{}, err
+		}
+		if !sameAddr(addr, from) {
+			if len(s.queue) < constants.QUEUE_SIZE {
+				s.queue = append(s.queue, datagram{msg: msg, addr: addr})
+			}
+			continue
+		}
+		decrypted, err := utils.Decrypt(msg, key)
+		if err != nil {
+			return Msg{}, err
+		}
+		var jsonData Msg
+		if err := decode([]byte(decrypted), &jsonData); err != nil {
+			return Msg{}, err
 		}
+		return jsonData, nil
 	}
-	msg = strings.Replace(msg, string(4), "", -1)
-	decrypted := utils.Decrypt(msg, key)
-	var jsonData Msg
-	json.Unmarshal([]byte(decrypted), &jsonData)
-	return jsonData.Type, jsonData.Data, addr.(*net.UDPAddr), err
 }
 
-func (s *Server) Bootstrap() {
-	hash := sha1.New()
-	io.WriteString(hash, s.BootAddr.IP.String())
-	bootID := hex.EncodeToString(hash.Sum(nil))
+func (s *Server) Bootstrap() error {
+	bootID := NodeID(s.BootAddr.IP)
 	bootPeer := &Peer{
 		ID:         bootID,
 		Addr:       s.BootAddr,
@@ -151,43 +217,48 @@ func (s *Server) Bootstrap() {
 	}
 
 	msgType, data, _, err := bootPeer.FindNode(s.ID)
-	utils.CheckError(err)
+	if err != nil {
+		return fmt.Errorf("bootstrap: %w", err)
+	}
+	if msgType != "found" {
+		return fmt.Errorf("bootstrap: %w", unexpected(msgType))
+	}
 
-	if msgType == "found" {
-		var neighbors []Tuple
-		err := json.Unmarshal(data, &neighbors)
-		utils.CheckError(err)
-		fmt.Println("")
-		bucket := &KBucket{K: 20, Difficulty: 3}
-		for _, neighbor := range neighbors {
-			hash := sha1.New()
-			io.WriteString(hash, neighbor.Addr.IP.String())
-			peer := &Peer{
-				ID:         hex.EncodeToString(hash.Sum(nil)),
-				Addr:       neighbor.Addr,
-				Difficulty: neighbor.Difficulty,
-				Generator:  big.NewInt(5),
-			}
+	var neighbors []Tuple
+	if err := decode(data, &neighbors); err != nil {
+		return fmt.Errorf("bootstrap: %w", err)
+	}
+	bucket := &KBucket{K: 20, Difficulty: 3}
+	for _, neighbor := range neighbors {
+		if neighbor.Addr == nil {
+			continue
+		}
+		peer := neighbor.AsPeer()
 
-			if peer.ID == bootPeer.ID {
+		if peer.ID == bootPeer.ID {
+			bucket.Add(peer)
+			s.peerJoined(peer)
+		} else {
+			response := peer.Ping()
+			if response && s.Table.FindPeer(peer.ID) == nil {
 				bucket.Add(peer)
-			} else {
-				response := peer.Ping()
-				if response && s.Table.FindPeer(peer.ID) == nil {
-					bucket.Add(peer)
-				}
+				s.peerJoined(peer)
 			}
-
 		}
-		s.Table.Append(bucket)
-		s.bootstrap(bucket)
+
 	}
+	if bucket.Size() == 0 {
+		return fmt.Errorf("bootstrap: %w: no reachable neighbors", ErrNotFound)
+	}
+	s.Table.AddBucket(bucket)
+	s.bootstrap(bucket)
+	return s.SyncEvents(bootPeer)
 }
 
+// bootstrap walks towards this node's ID. Peers that fail to answer are
+// skipped rather than ending the walk.
 func (s *Server) bootstrap(nearestBucket *KBucket) {
-	hash := sha1.New()
-	io.WriteString(hash, s.BootAddr.IP.String())
-	bootID := hex.EncodeToString(hash.Sum(nil))
+	bootID := NodeID(s.BootAddr.IP)
 
 	nearestPeer := nearestBucket.FindClosest(bootID)
 
@@ -198,160 +269,232 @@ func (s *Server) bootstrap(nearestBucket *KBucket) {
 	original := nearestPeer
 	aClosest := nearestBucket.FindAClosest(s.ID, s.A)
 	for _, p := range aClosest {
-		if p.ID != bootID {
-			msgType, data, _, err := p.FindNode(s.ID)
-			utils.CheckError(err)
-			if msgType == "found" {
-				var neighbors []Tuple
-				err := json.Unmarshal(data, &neighbors)
-				utils.CheckError(err)
-				fmt.Println("")
-				bucket := &KBucket{K: 20, Difficulty: 3}
-				for _, neighbor := range neighbors {
-					hash := sha1.New()
-					io.WriteString(hash, neighbor.Addr.IP.String())
-					peer := &Peer{
-						ID:         hex.EncodeToString(hash.Sum(nil)),
-						Addr:       neighbor.Addr,
-						Difficulty: neighbor.Difficulty,
-						Generator:  big.NewInt(5),
-					}
-
-					if s.Table.FindPeer(peer.ID) == nil && peer.ID != bootID && peer.ID != s.ID {
-						response := peer.Ping()
-						if response && s.Table.FindPeer(peer.ID) == nil {
-							s.Table.AddPeer(peer)
-							bucket.Add(peer)
-						}
-					}
-				}
-				if bucket.Size() > 0 {
-					closest := bucket.FindClosest(s.ID)
-					if closest.ID < nearestPeer.ID {
-						nearestPeer = closest
-						nearestBucket = bucket
-					}
+		if p.ID == bootID {
+			continue
+		}
+		msgType, data, _, err := p.FindNode(s.ID)
+		if err != nil || msgType != "found" {
+			continue
+		}
+		var neighbors []Tuple
+		if err := decode(data, &neighbors); err != nil {
+			continue
+		}
+		bucket := &KBucket{K: 20, Difficulty: 3}
+		for _, neighbor := range neighbors {
+			if neighbor.Addr == nil {
+				continue
+			}
+			peer := neighbor.AsPeer()
+
+			if s.Table.FindPeer(peer.ID) == nil && peer.ID != bootID && peer.ID != s.ID {
+				response := peer.Ping()
+				if response && s.Table.FindPeer(peer.ID) == nil {
+					s.Table.AddPeer(peer)
+					bucket.Add(peer)
+					s.peerJoined(peer)
 				}
 			}
 		}
+		if bucket.Size() > 0 {
+			closest := bucket.FindClosest(s.ID)
+			if closest.ID < nearestPeer.ID {
+				nearestPeer = closest
+				nearestBucket = bucket
+			}
+		}
 	}
 	if nearestPeer.ID < original.ID {
 		s.bootstrap(nearestBucket)
 	}
 }
 
-func (s *Server) Broadcast(event *Event) {
-	peers := s.Table.ListPeers()
-
-	var randPeers []*Peer
-	for i := 0; i < s.A; i++ {
-		rand.Seed(time.Now().UnixNano())
-		v := rand.Intn(len(randPeers))
-		randPeers = append(randPeers, peers[v])
-		peers = append(peers[:v], peers[v+1:]...)
+// addSender adds the node a request came from to the routing table.
+func (s *Server) addSender(addr *net.UDPAddr) {
+	peerID := NodeID(addr.IP)
+	if peerID == s.ID || s.Table.FindPeer(peerID) != nil {
+		return
 	}
+	newPeer := &Peer{
+		ID:         peerID,
+		Addr:       &net.UDPAddr{IP: addr.IP, Port: 4444},
+		Difficulty: 3,
+		Generator:  big.NewInt(5),
+	}
+	s.Table.AddPeer(newPeer)
+	s.peerJoined(newPeer)
+}
 
-	for _, peer := range randPeers {
-		msgRequest := MsgRequest{
-			Msg:       event.Data,
-			Signature: event.Signature,
-		}
-		msg, err := json.Marshal(msgRequest)
-		utils.CheckError(err)
-
-		peer.SendRecv("message", msg)
+func (s *Server) Listen() error {
+	conn, err := net.ListenUDP("udp", s.Addr)
+	if err != nil {
+		return err
 	}
+	return s.Serve(conn)
 }
 
-func (s *Server) Listen() {
-	var err error
-	s.Conn, err = net.ListenUDP("udp", s.Addr)
-	utils.CheckError(err)
+// Serve answers requests on conn until it is closed.
+func (s *Server) Serve(conn *net.UDPConn) error {
+	s.Conn = conn
 	defer s.Conn.Close()
+	s.logger("server").Info("listening", "addr", s.Addr.String(), "id", s.ID)
 	if s.BootAddr != nil {
-		s.Bootstrap()
+		if err := s.Bootstrap(); err != nil {
+			return err
+		}
+		s.logger("bootstrap").Info("bootstrapped", "peers", len(s.Table.ListPeers()), "events", s.Events.Len())
 	}
+	go s.logReorgs()
+	go s.syncLoop()
+	go s.topicLoop()
+	go s.gossipLoop()
+	go s.reconcileLoop()
+	go s.mailLoop()
+	go s.republishLoop()
+	go s.providerLoop()
+	go s.livenessLoop()
 	for {
-		key := s.GetKey()
-		if key == nil {
+		key, addr, err := s.GetKey()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			s.drop(addr, err)
 			continue
 		}
-		msgType, data, addr, err := s.Receive(key)
-		utils.CheckError(err)
-		if msgType == "find node" {
-			peerID := string(data)
-			bucket := s.Table.FindClosest(peerID)
-			if bucket != nil {
-				msg, err := json.Marshal(append(bucket.AsTuples(), s.AsTuple()))
-				utils.CheckError(err)
-				s.Send(addr, key, "found", msg)
-			} else {
-				msg, err := json.Marshal([]Tuple{s.AsTuple()})
-				utils.CheckError(err)
-				s.Send(addr, key, "found", msg)
-			}
-			if s.Table.FindPeer(peerID) == nil {
-				dst, err := net.ResolveUDPAddr("udp", addr.IP.String()+":4444")
-				utils.CheckError(err)
-				hash := sha1.New()
-				io.WriteString(hash, dst.IP.String())
-				newPeer := Peer{
-					ID:         hex.EncodeToString(hash.Sum(nil)),
-					Addr:       dst,
-					Difficulty: 3,
-					Generator:  big.NewInt(5),
-				}
-				s.Table.AddPeer(&newPeer)
-				fmt.Println("\n" + peerID + " joined!")
-				fmt.Print(">> ")
-			}
+		msg, err := s.Receive(key, addr)
+		if errors.Is(err, net.ErrClosed) {
+			return nil
 		}
-
-		if msgType == "ping" {
-			s.Send(addr, key, "pong", []byte(""))
-			hash := sha1.New()
-			io.WriteString(hash, addr.IP.String())
-			peerID := hex.EncodeToString(hash.Sum(nil))
-			if s.Table.FindPeer(peerID) == nil {
-				dst, err := net.ResolveUDPAddr("udp", addr.IP.String()+":4444")
-				utils.CheckError(err)
-				newPeer := Peer{
-					ID:         peerID,
-					Addr:       dst,
-					Difficulty: 3,
-					Generator:  big.NewInt(5),
-				}
-				s.Table.AddPeer(&newPeer)
-				fmt.Println("\n" + peerID + " joined!")
-				fmt.Print(">> ")
-			}
+		if errors.Is(err, ErrTimeout) {
+			s.drop(addr, err)
+			continue
 		}
+		if err != nil {
+			s.fault(addr, err)
+			continue
+		}
+		s.handle(addr, key, msg)
+	}
+}
 
-		if msgType == "message" {
-			var request MsgRequest
-			err := json.Unmarshal(data, &request)
-			utils.CheckError(err)
-			hash := sha1.New()
-			io.WriteString(hash, addr.IP.String())
-			peerID := hex.EncodeToString(hash.Sum(nil))
-			latest_event := s.Events.Last()
-			if (latest_event != nil && binary.BigEndian.Uint64(latest_event.Signature) != binary.BigEndian.Uint64(request.Signature)) || latest_event == nil {
-				if ed25519.Verify(s.PubKey, []byte(request.Msg), request.Signature) {
-					fmt.Println("\n"+peerID, request.Msg)
-					
-					event := &Event{Data: request.Msg, Signature: request.Signature}
-					s.Broadcast(event)
-					go s.Events.Append(event)
-				} else {
-					fmt.Println("The message is not authentic.")
-				}
+// handle dispatches a decrypted request. A handler that panics on a
+// malformed request only loses that request.
+func (s *Server) handle(addr *net.UDPAddr, key []byte, msg Msg) {
+	msgType, data := msg.Type, msg.Data
+	s.logger("server").Debug("request", "peer", NodeID(addr.IP), "type", msgType, "size", len(data))
+	DefaultMetrics.Inc("kademlia_requests_total", Label("type", requestType(msgType)))
+	defer func() {
+		if r := recover(); r != nil {
+			s.fault(addr, fmt.Errorf("%w: %q request: %v", ErrMalformed, msgType, r))
+		}
+	}()
 
-				fmt.Print(">> ")
-			}
+	if msgType == "find node" {
+		peerID := string(data)
+		if !ValidKey(peerID) {
+			s.fault(addr, fmt.Errorf("%w: invalid key", ErrMalformed))
+			return
+		}
+		s.sendClosest(addr, key, peerID)
+		s.emitDHT(DHTFindNode, peerID, addr)
+		if !msg.Crawl {
+			s.addSender(addr)
 		}
+	}
 
-		if msgType == "blacklist" {
-			s.Difficulty = 15
+	if msgType == "ping" {
+		s.Send(addr, key, "pong", []byte(constants.VERSION))
+		if !msg.Crawl {
+			s.addSender(addr)
 		}
 	}
+
+	if msgType == "message" {
+		s.handleMessage(addr, key, data)
+	}
+
+	if msgType == "ihave" {
+		s.handleIHave(addr, key, data)
+	}
+
+	if msgType == "store" {
+		s.handleStore(addr, key, data)
+	}
+
+	if msgType == "find value" {
+		s.handleFindValue(addr, key, data)
+	}
+
+	if msgType == "add provider" {
+		s.handleAddProvider(addr, key, data)
+	}
+
+	if msgType == "get providers" {
+		s.handleGetProviders(addr, key, data)
+	}
+
+	if msgType == "store record" {
+		s.handleStoreRecord(addr, key, data)
+	}
+
+	if msgType == "find record" {
+		s.handleFindRecord(addr, key, data)
+	}
+
+	if msgType == "chain head" {
+		s.handleChainHead(addr, key)
+	}
+
+	if msgType == "get events" {
+		s.handleGetEvents(addr, key, data)
+	}
+
+	if msgType == "merkle children" {
+		s.handleMerkleChildren(addr, key, data)
+	}
+
+	if msgType == "merkle leaves" {
+		s.handleMerkleLeaves(addr, key, data)
+	}
+
+	if msgType == "get event" {
+		s.handleGetEvent(addr, key, data)
+	}
+
+	if msgType == "direct" {
+		s.handleDirect(addr, key, data)
+	}
+
+	if msgType == "deposit" {
+		s.handleDeposit(addr, key, data)
+	}
+
+	if msgType == "collect" {
+		s.handleCollect(addr, key, data)
+	}
+
+	if msgType == "collected" {
+		s.handleCollected(addr, key, data)
+	}
+
+	if msgType == "mail key" {
+		s.handleMailKey(addr, key, data)
+	}
+
+	if msgType == "graft" {
+		s.handleGraft(addr, key, data)
+	}
+
+	if msgType == "prune" {
+		s.handlePrune(addr, key, data)
+	}
+
+	if msgType == "publish" {
+		s.handlePublish(addr, key, data)
+	}
+
+	if msgType == "blacklist" {
+		s.logger("server").Info("blacklisted by peer", "peer", NodeID(addr.IP))
+	}
 }
@@ -0,0 +1,220 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kademlia/constants"
+	"kademlia/utils"
+	"sync"
+)
+
+// Manifest describes a blob split into content-addressed chunks. Index is
+// the key of the top of a tree of IndexNodes whose leaves are the chunk keys,
+// so that no single value has to hold the whole chunk list.
+type Manifest struct {
+	Root   string `json:"root"`
+	Size   int64  `json:"size"`
+	Chunks int    `json:"chunks"`
+	Index  string `json:"index"`
+	Depth  int    `json:"depth"`
+}
+
+type IndexNode struct {
+	Links []string `json:"links"`
+}
+
+// indexDepth is the depth of the index tree over n chunks.
+func indexDepth(n int) int {
+	depth := 0
+	for width := 1; width < n; width *= constants.INDEX_FANOUT {
+		depth += 1
+	}
+	return depth
+}
+
+// check rejects manifests that would make GetBlob fetch more than
+// MAX_BLOB_CHUNKS chunks or walk deeper than their index can be.
+func (m *Manifest) check() error {
+	if m.Chunks < 1 || m.Chunks > constants.MAX_BLOB_CHUNKS {
+		return fmt.Errorf("%w: manifest has %d chunks", ErrMalformed, m.Chunks)
+	}
+	if m.Depth != indexDepth(m.Chunks) {
+		return fmt.Errorf("%w: manifest depth %d for %d chunks", ErrMalformed, m.Depth, m.Chunks)
+	}
+	if m.Size < 0 || m.Size > int64(m.Chunks)*constants.CHUNK_SIZE || !ValidKey(m.Index) {
+		return fmt.Errorf("%w: invalid manifest", ErrMalformed)
+	}
+	return nil
+}
+
+// splitChunks cuts data into CHUNK_SIZE chunks, the most a store request
+// carries in one BUFFER datagram once encoded and encrypted.
+func splitChunks(data []byte) [][]byte {
+	var chunks [][]byte
+	for i := 0; i < len(data); i += constants.CHUNK_SIZE {
+		end := i + constants.CHUNK_SIZE
+		if end > len(data) {
+			end = len(data)
+		}
+		chunks = append(chunks, data[i:end])
+	}
+	return chunks
+}
+
+// putAll stores values in parallel and returns their keys in order.
+func (s *Server) putAll(values [][]byte) ([]string, error) {
+	keys := make([]string, len(values))
+	errs := make([]error, len(values))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < constants.BLOB_WORKERS; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				keys[i], errs[i] = s.Put(values[i])
+			}
+		}()
+	}
+	for i := range values {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// getAll fetches and verifies values in parallel, in the order of keys.
+func (s *Server) getAll(keys []string) ([][]byte, error) {
+	values := make([][]byte, len(keys))
+	errs := make([]error, len(keys))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < constants.BLOB_WORKERS; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				values[i], errs[i] = s.Get(keys[i])
+			}
+		}()
+	}
+	for i := range keys {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("chunk %s: %w", keys[i], err)
+		}
+	}
+	return values, nil
+}
+
+// PutBlob stores data of any size as chunks plus an index tree and returns
+// the key of its manifest.
+func (s *Server) PutBlob(data []byte) (string, error) {
+	chunks := splitChunks(data)
+	if len(chunks) == 0 {
+		chunks = [][]byte{{}}
+	}
+	if len(chunks) > constants.MAX_BLOB_CHUNKS {
+		return "", ErrValueTooBig
+	}
+	chunkKeys, err := s.putAll(chunks)
+	if err != nil {
+		return "", err
+	}
+
+	manifest := Manifest{
+		Root:   utils.MerkleRoot(chunkKeys),
+		Size:   int64(len(data)),
+		Chunks: len(chunkKeys),
+	}
+	level := chunkKeys
+	for len(level) > 1 {
+		var nodes [][]byte
+		for i := 0; i < len(level); i += constants.INDEX_FANOUT {
+			end := i + constants.INDEX_FANOUT
+			if end > len(level) {
+				end = len(level)
+			}
+			node, err := json.Marshal(IndexNode{Links: level[i:end]})
+			if err != nil {
+				return "", err
+			}
+			nodes = append(nodes, node)
+		}
+		level, err = s.putAll(nodes)
+		if err != nil {
+			return "", err
+		}
+		manifest.Depth += 1
+	}
+	manifest.Index = level[0]
+
+	data, err = json.Marshal(manifest)
+	if err != nil {
+		return "", err
+	}
+	return s.Put(data)
+}
+
+// GetBlob fetches the manifest under key, walks its index and reassembles
+// the blob, checking every chunk and the Merkle root over all of them.
+func (s *Server) GetBlob(key string) ([]byte, error) {
+	data, err := s.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	var manifest Manifest
+	if err := decode(data, &manifest); err != nil {
+		return nil, err
+	}
+	if err := manifest.check(); err != nil {
+		return nil, err
+	}
+
+	level := []string{manifest.Index}
+	for depth := 0; depth < manifest.Depth; depth++ {
+		nodes, err := s.getAll(level)
+		if err != nil {
+			return nil, err
+		}
+		var next []string
+		for _, data := range nodes {
+			var node IndexNode
+			if err := decode(data, &node); err != nil {
+				return nil, err
+			}
+			next = append(next, node.Links...)
+			if len(next) > manifest.Chunks {
+				return nil, errors.New("blob index does not match manifest root")
+			}
+		}
+		level = next
+	}
+	if len(level) != manifest.Chunks || utils.MerkleRoot(level) != manifest.Root {
+		return nil, errors.New("blob index does not match manifest root")
+	}
+
+	chunks, err := s.getAll(level)
+	if err != nil {
+		return nil, err
+	}
+	var blob []byte
+	for _, chunk := range chunks {
+		blob = append(blob, chunk...)
+	}
+	if int64(len(blob)) != manifest.Size {
+		return nil, errors.New("blob size does not match manifest")
+	}
+	return blob, nil
+}
@@ -0,0 +1,70 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"kademlia/constants"
+	"kademlia/utils"
+	"testing"
+)
+
+// TestChunkFitsDatagram checks that storing a full chunk stays within the
+// BUFFER a server reads a datagram into.
+func TestChunkFitsDatagram(t *testing.T) {
+	chunk := bytes.Repeat([]byte{0xff}, constants.CHUNK_SIZE)
+	request, _ := json.Marshal(StoreRequest{Key: ContentKey(chunk), Value: chunk, TTL: constants.CACHE_TTL})
+	msg, _ := json.Marshal(Msg{Type: "store", Data: request})
+	encrypted, err := utils.Encrypt(msg, make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := len(encrypted) + 1; size > constants.BUFFER {
+		t.Fatalf("a stored chunk takes %d bytes, more than %d", size, constants.BUFFER)
+	}
+}
+
+func TestManifestCheck(t *testing.T) {
+	index := ContentKey([]byte("index"))
+	for _, tc := range []struct {
+		manifest Manifest
+		valid    bool
+	}{
+		{Manifest{Chunks: 1, Depth: 0, Size: 10, Index: index}, true},
+		{Manifest{Chunks: 13, Depth: 2, Size: 10, Index: index}, true},
+		{Manifest{Chunks: 13, Depth: 1, Size: 10, Index: index}, false},
+		{Manifest{Chunks: 1, Depth: 1 << 30, Size: 10, Index: index}, false},
+		{Manifest{Chunks: constants.MAX_BLOB_CHUNKS + 1, Depth: indexDepth(constants.MAX_BLOB_CHUNKS + 1), Index: index}, false},
+		{Manifest{Chunks: 0, Depth: 0, Index: index}, false},
+		{Manifest{Chunks: 1, Depth: 0, Size: constants.CHUNK_SIZE + 1, Index: index}, false},
+	} {
+		err := tc.manifest.check()
+		if tc.valid && err != nil {
+			t.Errorf("%+v: %v", tc.manifest, err)
+		}
+		if !tc.valid && !errors.Is(err, ErrMalformed) {
+			t.Errorf("%+v: accepted", tc.manifest)
+		}
+	}
+}
+
+func TestBlobRoundTrip(t *testing.T) {
+	a := startTestServer(t, "127.0.0.1")
+	b := newTestServer("127.0.0.2")
+	b.Table.AddPeer(testPeer(a))
+
+	blob := bytes.Repeat([]byte("0123456789"), constants.CHUNK_SIZE*2)
+	key, err := b.PutBlob(blob)
+	if err != nil {
+		t.Fatalf("put blob: %v", err)
+	}
+	c := newTestServer("127.0.0.3")
+	c.Table.AddPeer(testPeer(a))
+	got, err := c.GetBlob(key)
+	if err != nil {
+		t.Fatalf("get blob: %v", err)
+	}
+	if !bytes.Equal(got, blob) {
+		t.Fatal("blob changed in transit")
+	}
+}
@@ -7,12 +7,32 @@ import (
 	"kademlia/utils"
 	"math"
 	"math/rand"
+	"sort"
+	"sync"
 	"time"
 )
 
+// RoutingTable is a ring of k-buckets. The methods the server calls from
+// its goroutines lock mu; the list primitives below them don't.
 type RoutingTable struct {
 	Head *KBucket `json:"head"`
 	K    int      `json:"k"`
+	mu   sync.RWMutex
+}
+
+// Empty reports whether the table holds no buckets.
+func (rt *RoutingTable) Empty() bool {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	return rt.Head == nil
+}
+
+// AddBucket inserts a bucket of peers, such as the one bootstrapping starts
+// from.
+func (rt *RoutingTable) AddBucket(bucket *KBucket) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.Insert(bucket)
 }
 
 func (rt *RoutingTable) Len() int {
@@ -56,7 +76,13 @@ func (rt *RoutingTable) Prepend(newBucket *KBucket) {
 	rt.Head = newBucket
 }
 
+// AddPeer adds a peer unless the table already holds one with its ID.
 func (rt *RoutingTable) AddPeer(newPeer *Peer) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if rt.findPeer(newPeer.ID) != nil {
+		return
+	}
 	bucket := rt.FindClosest(newPeer.ID)
 	if bucket == nil {
 		bucket = &KBucket{K: 20, Difficulty: 3}
@@ -86,17 +112,35 @@ func (rt *RoutingTable) AddPeer(newPeer *Peer) {
 }
 
 func (rt *RoutingTable) FindPeer(id string) *Peer {
-	bucket := rt.FindClosest(id)
-	if bucket != nil {
-		peer := bucket.FindNode(id)
-		if peer == nil {
-			peer = bucket.Prev.FindNode(id)
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	return rt.findPeer(id)
+}
+
+// findPeer searches every bucket, since a peer isn't always in the bucket
+// closest to its ID once buckets have split.
+func (rt *RoutingTable) findPeer(id string) *Peer {
+	for _, bucket := range rt.List() {
+		if peer := bucket.FindNode(id); peer != nil {
+			return peer
 		}
+	}
+	return nil
+}
 
-		if peer == nil {
-			peer = bucket.Next.FindNode(id)
+// RemovePeer deletes the peer with id from the bucket holding it, dropping
+// the bucket once it is empty.
+func (rt *RoutingTable) RemovePeer(id string) *Peer {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	for _, bucket := range rt.List() {
+		if peer := bucket.FindNode(id); peer != nil {
+			bucket.Delete(id)
+			if bucket.Root == nil {
+				rt.DeleteBucket(bucket)
+			}
+			return peer
 		}
-		return peer
 	}
 	return nil
 }
@@ -400,7 +444,7 @@ func quickSort(peers []*Peer, start int, end int) []*Peer {
 	return peers
 }
 
-func (rt *RoutingTable) Sort() RoutingTable {
+func (rt *RoutingTable) Sort() *RoutingTable {
 	var peers []*Peer
 	current := rt.Head
 	for {
@@ -424,7 +468,7 @@ func (rt *RoutingTable) Sort() RoutingTable {
 		}
 		table.Append(&bucket)
 	}
-	return table
+	return &table
 }
 
 func (rt *RoutingTable) Josephus(step int) {
@@ -467,8 +511,17 @@ func (rt *RoutingTable) List() []*KBucket {
 }
 
 func (rt *RoutingTable) ListPeers() []*Peer {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	return rt.listPeers()
+}
+
+func (rt *RoutingTable) listPeers() []*Peer {
 	var peers []*Peer
 	current := rt.Head
+	if current == nil {
+		return peers
+	}
 	for {
 		for _, peer := range current.InOrder() {
 			peers = append(peers, peer)
@@ -481,9 +534,31 @@ func (rt *RoutingTable) ListPeers() []*Peer {
 	return peers
 }
 
+func (rt *RoutingTable) FindKClosest(id string, k int) []*Peer {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	peers := rt.listPeers()
+	SortByDistance(peers, id)
+	if len(peers) > k {
+		peers = peers[:k]
+	}
+	return peers
+}
+
+func SortByDistance(peers []*Peer, id string) {
+	sort.SliceStable(peers, func(i, j int) bool {
+		return utils.Distance(peers[i].ID, id) < utils.Distance(peers[j].ID, id)
+	})
+}
+
 func (rt *RoutingTable) AsTuples() []Tuple {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
 	current := rt.Head
 	var tuples []Tuple
+	if current == nil {
+		return tuples
+	}
 	for {
 		for _, peer := range current.PreOrder() {
 			tuples = append(tuples, peer.AsTuple())
@@ -0,0 +1,73 @@
+package models
+
+import (
+	"fmt"
+	"kademlia/constants"
+	"net"
+	"sync"
+	"testing"
+)
+
+func testPeers(n int) []*Peer {
+	var peers []*Peer
+	for i := 0; i < n; i++ {
+		addr := &net.UDPAddr{IP: net.ParseIP(fmt.Sprintf("10.0.%d.%d", i/250, i%250+1)), Port: 4444}
+		peers = append(peers, Tuple{Addr: addr, Difficulty: 3}.AsPeer())
+	}
+	return peers
+}
+
+// TestRoutingTableConcurrent exercises the table the way the server's
+// goroutines do; run it with -race.
+func TestRoutingTableConcurrent(t *testing.T) {
+	table := RoutingTable{K: 20}
+	peers := testPeers(200)
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < len(peers); i += 4 {
+				table.AddPeer(peers[i])
+				table.FindKClosest(peers[i].ID, 20)
+				table.BucketInfos()
+				if i%3 == 0 {
+					table.RemovePeer(peers[i].ID)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	for i, peer := range peers {
+		found := table.FindPeer(peer.ID) != nil
+		if found != (i%3 != 0) {
+			t.Errorf("peer %d: in table %v", i, found)
+		}
+	}
+}
+
+func TestAddPeerTwice(t *testing.T) {
+	table := RoutingTable{K: 20}
+	peer := testPeers(1)[0]
+	table.AddPeer(peer)
+	table.AddPeer(peer.AsTuple().AsPeer())
+	if n := len(table.ListPeers()); n != 1 {
+		t.Fatalf("table holds %d peers", n)
+	}
+}
+
+func TestLivenessEviction(t *testing.T) {
+	s := newTestServer("127.0.0.1")
+	gone := Tuple{Addr: &net.UDPAddr{IP: net.ParseIP("127.0.0.9"), Port: 4444}, Difficulty: 3}.AsPeer()
+	s.Table.AddPeer(gone)
+	for i := 1; i < constants.LIVENESS_FAILURES; i++ {
+		s.checkLiveness()
+		if s.Table.FindPeer(gone.ID) == nil {
+			t.Fatalf("evicted after %d failed pings", i)
+		}
+	}
+	s.checkLiveness()
+	if s.Table.FindPeer(gone.ID) != nil {
+		t.Fatalf("kept after %d failed pings", constants.LIVENESS_FAILURES)
+	}
+}
@@ -0,0 +1,182 @@
+package models
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"kademlia/constants"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CrawlNode is what a crawl learned about a node. Queried counts the
+// requests sent to it and Answered the ones it replied to.
+type CrawlNode struct {
+	ID         string        `json:"id"`
+	Addr       string        `json:"address"`
+	Responsive bool          `json:"responsive"`
+	Version    string        `json:"version"`
+	Queried    int           `json:"queried"`
+	Answered   int           `json:"answered"`
+	RTT        time.Duration `json:"rtt"`
+	Neighbors  []string      `json:"neighbors"`
+}
+
+// Topology is what a crawl found: every node reached, keyed by ID, and the
+// contacts each returned. Root is the crawling node.
+type Topology struct {
+	Root  string                `json:"root"`
+	Nodes map[string]*CrawlNode `json:"nodes"`
+}
+
+// crawlTargets spreads n IDs evenly over the keyspace, so that together
+// they draw contacts from every bucket of a node's routing table.
+func crawlTargets(n int) []string {
+	targets := make([]string, n)
+	step := math.MaxUint64 / uint64(n)
+	for i := range targets {
+		targets[i] = fmt.Sprintf("%016x", uint64(i)*step) + strings.Repeat("0", 24)
+	}
+	return targets
+}
+
+// crawlNode asks a node for its version and for the contacts closest to
+// its own ID and to each target, all through the one peer. The RTT kept is
+// that of the last request.
+func crawlNode(peer *Peer, targets []string) (*CrawlNode, []Tuple) {
+	node := &CrawlNode{ID: peer.ID, Addr: peer.Addr.String(), Neighbors: []string{}}
+	node.Queried += 1
+	version, err := peer.Version()
+	if err != nil {
+		return node, nil
+	}
+	node.Answered += 1
+	node.Version = version
+	seen := make(map[string]bool)
+	var contacts []Tuple
+	for _, target := range append([]string{peer.ID}, targets...) {
+		node.Queried += 1
+		msgType, data, _, err := peer.FindNode(target)
+		if err != nil || msgType != "found" {
+			continue
+		}
+		var neighbors []Tuple
+		if err := decode(data, &neighbors); err != nil {
+			continue
+		}
+		node.Answered += 1
+		for _, neighbor := range neighbors {
+			if neighbor.Addr == nil {
+				continue
+			}
+			id := NodeID(neighbor.Addr.IP)
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			contacts = append(contacts, neighbor)
+			node.Neighbors = append(node.Neighbors, id)
+		}
+	}
+	node.Responsive = true
+	_, node.RTT = peer.Stats()
+	return node, contacts
+}
+
+// Crawl walks the network from the routing table and the bootstrap node.
+func (s *Server) Crawl(limit int) *Topology {
+	var seeds []Tuple
+	if !s.Table.Empty() {
+		seeds = s.Table.AsTuples()
+	}
+	if s.BootAddr != nil {
+		seeds = append(seeds, Tuple{Addr: s.BootAddr, Difficulty: 3})
+	}
+	return s.CrawlFrom(seeds, limit)
+}
+
+// CrawlFrom walks the network breadth first from seeds, querying up to
+// limit nodes CRAWL_WORKERS at a time. Each node is asked for the contacts
+// closest to CRAWL_TARGETS IDs spread across the keyspace, so the crawl
+// reaches beyond the neighbourhoods of the seeds. Requests are marked as
+// crawler requests so the crawled nodes don't add this node to their
+// routing tables.
+func (s *Server) CrawlFrom(seeds []Tuple, limit int) *Topology {
+	topology := &Topology{Root: s.ID, Nodes: make(map[string]*CrawlNode)}
+	root := &CrawlNode{ID: s.ID, Responsive: true, Version: constants.VERSION, Neighbors: []string{}}
+	if s.Addr != nil {
+		root.Addr = s.Addr.String()
+	}
+	topology.Nodes[s.ID] = root
+	for _, seed := range seeds {
+		root.Neighbors = append(root.Neighbors, NodeID(seed.Addr.IP))
+	}
+	targets := crawlTargets(constants.CRAWL_TARGETS)
+	queued := map[string]bool{s.ID: true}
+	frontier := seeds
+	for len(frontier) > 0 {
+		var next []Tuple
+		var mu sync.Mutex
+		jobs := make(chan *Peer)
+		var wg sync.WaitGroup
+		for w := 0; w < constants.CRAWL_WORKERS; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for peer := range jobs {
+					node, contacts := crawlNode(peer, targets)
+					mu.Lock()
+					topology.Nodes[node.ID] = node
+					next = append(next, contacts...)
+					mu.Unlock()
+				}
+			}()
+		}
+		for _, contact := range frontier {
+			id := NodeID(contact.Addr.IP)
+			if queued[id] || len(queued) > limit {
+				continue
+			}
+			queued[id] = true
+			peer := contact.AsPeer()
+			peer.crawler = true
+			jobs <- peer
+		}
+		close(jobs)
+		wg.Wait()
+		s.logger("crawl").Debug("crawl round", "nodes", len(topology.Nodes), "contacts", len(next))
+		frontier = next
+	}
+	s.logger("crawl").Info("crawl finished", "nodes", len(topology.Nodes))
+	return topology
+}
+
+// WriteCrawlCSV writes one row per crawled node, sorted by ID.
+func WriteCrawlCSV(w io.Writer, topology *Topology) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"id", "address", "responsive", "version", "queried", "answered", "rtt_ms", "neighbors"})
+	var ids []string
+	for id := range topology.Nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		node := topology.Nodes[id]
+		writer.Write([]string{
+			node.ID,
+			node.Addr,
+			strconv.FormatBool(node.Responsive),
+			node.Version,
+			strconv.Itoa(node.Queried),
+			strconv.Itoa(node.Answered),
+			strconv.FormatFloat(float64(node.RTT)/float64(time.Millisecond), 'f', 1, 64),
+			strconv.Itoa(len(node.Neighbors)),
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
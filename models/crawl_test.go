@@ -0,0 +1,24 @@
+package models
+
+import "testing"
+
+func TestCrawlLeavesNoTrace(t *testing.T) {
+	a := startTestServer(t, "127.0.0.2")
+	b := startTestServer(t, "127.0.0.3")
+	a.Table.AddPeer(testPeer(b))
+
+	crawler := newTestServer("127.0.0.4")
+	topology := crawler.CrawlFrom([]Tuple{a.AsTuple()}, 10)
+	for _, s := range []*Server{a, b} {
+		node := topology.Nodes[s.ID]
+		if node == nil || !node.Responsive || node.Answered != node.Queried {
+			t.Fatalf("crawl of %s gave %+v", s.ID, node)
+		}
+	}
+	if peers := a.Table.ListPeers(); len(peers) != 1 || peers[0].ID != b.ID {
+		t.Fatalf("crawled node added %d peers", len(peers))
+	}
+	if !testPeer(a).Ping() || len(a.Table.ListPeers()) != 2 {
+		t.Fatal("ping sender not added")
+	}
+}
@@ -0,0 +1,393 @@
+package models
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kademlia/constants"
+	"kademlia/utils"
+	"math/bits"
+	"net"
+	"sync"
+	"time"
+)
+
+func (s *Server) closestTuples(id string) []Tuple {
+	var tuples []Tuple
+	for _, peer := range s.Table.FindKClosest(id, s.Table.K) {
+		tuples = append(tuples, peer.AsTuple())
+	}
+	return append(tuples, s.AsTuple())
+}
+
+func (s *Server) sendClosest(addr *net.UDPAddr, key []byte, id string) {
+	msg, err := json.Marshal(s.closestTuples(id))
+	if err != nil {
+		return
+	}
+	s.Send(addr, key, "found", msg)
+}
+
+// replicate calls store on each of the k closest nodes to key and returns
+// how many of them succeeded.
+func (s *Server) replicate(key string, store func(peer *Peer) error) int {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	stored := 0
+	peers := s.Lookup(key)
+	if replicas := s.replicas(s.NetworkSize().Estimate); len(peers) > replicas {
+		peers = peers[:replicas]
+	}
+	for _, peer := range peers {
+		wg.Add(1)
+		go func(peer *Peer) {
+			defer wg.Done()
+			if store(peer) == nil {
+				mu.Lock()
+				stored += 1
+				mu.Unlock()
+			}
+		}(peer)
+	}
+	wg.Wait()
+	return stored
+}
+
+func (s *Server) handleStore(addr *net.UDPAddr, key []byte, data []byte) {
+	var request StoreRequest
+	err := decode(data, &request)
+	if err == nil && request.TTL > 0 {
+		ttl := time.Duration(request.TTL) * time.Second
+		if ttl > constants.CACHE_TTL*time.Second {
+			ttl = constants.CACHE_TTL * time.Second
+		}
+		err = s.Values.Cache(request.Key, request.Value, ttl)
+	} else if err == nil {
+		err = s.Values.Put(request.Key, request.Value)
+	}
+	if err != nil {
+		s.Send(addr, key, "rejected", []byte(err.Error()))
+		return
+	}
+	s.Send(addr, key, "stored", []byte(""))
+	s.emitDHT(DHTStore, request.Key, addr)
+}
+
+func (s *Server) handleFindValue(addr *net.UDPAddr, key []byte, data []byte) {
+	valueKey := string(data)
+	if !ValidKey(valueKey) {
+		s.fault(addr, fmt.Errorf("%w: invalid key", ErrMalformed))
+		return
+	}
+	value := s.Values.Get(valueKey)
+	s.emitDHT(DHTFindValue, valueKey, addr)
+	if value == nil {
+		s.sendClosest(addr, key, valueKey)
+		return
+	}
+	s.Send(addr, key, "value", value)
+}
+
+func (s *Server) handleAddProvider(addr *net.UDPAddr, key []byte, data []byte) {
+	var request ProviderRequest
+	if err := decode(data, &request); err != nil || !ValidKey(request.Key) {
+		s.Send(addr, key, "rejected", []byte("malformed provider request"))
+		return
+	}
+	ttl := time.Duration(request.TTL) * time.Second
+	if ttl <= 0 || ttl > constants.PROVIDER_TTL*time.Second {
+		ttl = constants.PROVIDER_TTL * time.Second
+	}
+	// Providers can only announce themselves.
+	provider := Tuple{
+		Addr:       &net.UDPAddr{IP: addr.IP, Port: 4444},
+		Difficulty: request.Provider.Difficulty,
+	}
+	if err := s.Values.AddProvider(request.Key, provider, ttl); err != nil {
+		s.Send(addr, key, "rejected", []byte(err.Error()))
+		return
+	}
+	s.Send(addr, key, "stored", []byte(""))
+	s.emitDHT(DHTAddProvider, request.Key, addr)
+}
+
+// handleGetProviders answers with the providers of a key and the contacts
+// closest to it, dropping contacts and then providers until the answer fits
+// in a single datagram.
+func (s *Server) handleGetProviders(addr *net.UDPAddr, key []byte, data []byte) {
+	providerKey := string(data)
+	if !ValidKey(providerKey) {
+		s.fault(addr, fmt.Errorf("%w: invalid key", ErrMalformed))
+		return
+	}
+	s.emitDHT(DHTGetProviders, providerKey, addr)
+	response := ProvidersResponse{
+		Providers: s.Values.GetProviders(providerKey),
+		Closer:    s.closestTuples(providerKey),
+	}
+	msg, err := json.Marshal(response)
+	for err == nil && len(msg) > constants.MAX_VALUE_SIZE && len(response.Closer)+len(response.Providers) > 1 {
+		if len(response.Closer) > 0 {
+			response.Closer = response.Closer[:len(response.Closer)-1]
+		} else {
+			response.Providers = response.Providers[:len(response.Providers)-1]
+		}
+		msg, err = json.Marshal(response)
+	}
+	if err != nil {
+		return
+	}
+	s.Send(addr, key, "providers", msg)
+}
+
+func (s *Server) handleStoreRecord(addr *net.UDPAddr, key []byte, data []byte) {
+	var record Record
+	err := decode(data, &record)
+	if err == nil {
+		err = s.Values.PutRecord(&record)
+	}
+	if err != nil {
+		s.Send(addr, key, "rejected", []byte(err.Error()))
+		return
+	}
+	s.Send(addr, key, "stored", []byte(""))
+	s.emitDHT(DHTStoreRecord, record.Key(), addr)
+}
+
+func (s *Server) handleFindRecord(addr *net.UDPAddr, key []byte, data []byte) {
+	recordKey := string(data)
+	if !ValidKey(recordKey) {
+		s.fault(addr, fmt.Errorf("%w: invalid key", ErrMalformed))
+		return
+	}
+	record := s.Values.GetRecord(recordKey)
+	s.emitDHT(DHTFindRecord, recordKey, addr)
+	if record == nil {
+		s.sendClosest(addr, key, recordKey)
+		return
+	}
+	msg, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	s.Send(addr, key, "record", msg)
+}
+
+// PutRecord publishes record locally and on the k closest nodes to its key
+// and returns how many of them accepted it. It is republished along with
+// the values this node published.
+func (s *Server) PutRecord(record *Record) (int, error) {
+	if err := s.Values.PublishRecord(record); err != nil {
+		return 0, err
+	}
+	return s.replicate(record.Key(), func(peer *Peer) error {
+		return peer.StoreRecord(record)
+	}), nil
+}
+
+// GetRecord returns the valid record with the highest sequence number found
+// on the nodes closest to key.
+func (s *Server) GetRecord(key string) *Record {
+	var mu sync.Mutex
+	latest := s.Values.GetRecord(key)
+	s.lookup(key, func(peer *Peer) ([]Tuple, bool, error) {
+		record, neighbors, err := peer.FindRecord(key)
+		if err != nil {
+			return nil, false, err
+		}
+		if record != nil && record.Key() == key && record.Verify() == nil {
+			mu.Lock()
+			if latest == nil || record.Seq > latest.Seq {
+				latest = record
+			}
+			mu.Unlock()
+		}
+		return neighbors, false, nil
+	})
+	if latest != nil {
+		s.Values.PutRecord(latest)
+	}
+	return latest
+}
+
+// PublishRecord signs value under privKey and salt with the next sequence
+// number and stores it in the network.
+func (s *Server) PublishRecord(privKey ed25519.PrivateKey, salt string, value []byte) (*Record, error) {
+	pubKey := privKey.Public().(ed25519.PublicKey)
+	record := &Record{Salt: salt, Value: value}
+	current := s.GetRecord(RecordKey(pubKey, salt))
+	if current != nil {
+		record.Seq = current.Seq + 1
+	}
+	record.Sign(privKey)
+	stored, err := s.PutRecord(record)
+	if err != nil {
+		return nil, err
+	}
+	if stored == 0 && !s.Table.Empty() {
+		return record, errors.New("no peer accepted the record")
+	}
+	return record, nil
+}
+
+// Put stores an immutable value under the SHA-256 of its contents on the k
+// closest nodes to that key and returns the key.
+func (s *Server) Put(value []byte) (string, error) {
+	key := ContentKey(value)
+	if err := s.Values.Publish(key, value); err != nil {
+		return "", err
+	}
+	stored := s.replicate(key, func(peer *Peer) error {
+		return peer.Store(key, value)
+	})
+	if stored == 0 && !s.Table.Empty() {
+		return key, errors.New("no peer accepted the value")
+	}
+	return key, nil
+}
+
+// republish stores the values and records this node published on the
+// nodes now closest to them again, before the copies they hold expire.
+func (s *Server) republish() {
+	for key, value := range s.Values.Published() {
+		stored := s.replicate(key, func(peer *Peer) error {
+			return peer.Store(key, value)
+		})
+		s.logger("dht").Debug("republished", "key", key, "replicas", stored)
+	}
+	for _, record := range s.Values.PublishedRecords() {
+		stored := s.replicate(record.Key(), func(peer *Peer) error {
+			return peer.StoreRecord(record)
+		})
+		s.logger("dht").Debug("republished record", "key", record.Key(), "replicas", stored)
+	}
+}
+
+func (s *Server) providerLoop() {
+	for {
+		time.Sleep(constants.PROVIDER_INTERVAL * time.Second)
+		s.Values.ExpireProviders()
+	}
+}
+
+func (s *Server) republishLoop() {
+	for {
+		time.Sleep(constants.REPUBLISH_INTERVAL * time.Second)
+		s.republish()
+	}
+}
+
+// Get looks up an immutable value, discarding any reply whose contents do
+// not hash to key. Once found, the value is cached on the closest node that
+// did not have it, with an expiry that halves for every bit of distance
+// between that node and the one that answered.
+func (s *Server) Get(key string) ([]byte, error) {
+	if value := s.Values.Get(key); value != nil {
+		return value, nil
+	}
+	var mu sync.Mutex
+	var found []byte
+	var holder *Peer
+	var misses []*Peer
+	s.lookup(key, func(peer *Peer) ([]Tuple, bool, error) {
+		value, neighbors, err := peer.FindValue(key)
+		if err != nil {
+			return nil, false, err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if value != nil {
+			found = value
+			holder = peer
+			return nil, true, nil
+		}
+		misses = append(misses, peer)
+		return neighbors, false, nil
+	})
+	if found == nil {
+		return nil, ErrNotFound
+	}
+	if len(misses) > 0 {
+		SortByDistance(misses, key)
+		go misses[0].Cache(key, found, cacheTTL(key, holder, misses[0]))
+	}
+	return found, nil
+}
+
+func cacheTTL(key string, holder *Peer, cache *Peer) time.Duration {
+	ttl := constants.CACHE_TTL * time.Second
+	extra := bits.Len64(utils.Distance(cache.ID, key)) - bits.Len64(utils.Distance(holder.ID, key))
+	if extra > 0 {
+		ttl >>= uint(extra)
+	}
+	if ttl < time.Second {
+		ttl = time.Second
+	}
+	return ttl
+}
+
+// Announce registers this node as a provider of key on the k closest nodes
+// to it. Records expire after PROVIDER_TTL, so callers should re-announce
+// periodically.
+func (s *Server) Announce(key string) (int, error) {
+	ttl := constants.PROVIDER_TTL * time.Second
+	local := s.Values.AddProvider(key, s.AsTuple(), ttl)
+	if s.Table.Empty() {
+		return 0, local
+	}
+	stored := s.replicate(key, func(peer *Peer) error {
+		return peer.AddProvider(key, s.AsTuple(), ttl)
+	})
+	if stored == 0 {
+		return 0, errors.New("no peer accepted the provider record")
+	}
+	return stored, nil
+}
+
+// FindProviders streams up to n distinct providers of key as the lookup
+// discovers them. The channel is closed when the lookup ends; closing done
+// ends it early once the caller stops reading.
+func (s *Server) FindProviders(key string, n int, done <-chan struct{}) <-chan Tuple {
+	found := make(chan Tuple)
+	go func() {
+		defer close(found)
+		var mu sync.Mutex
+		seen := map[string]bool{}
+		emit := func(providers []Tuple) bool {
+			mu.Lock()
+			var fresh []Tuple
+			for _, provider := range providers {
+				if len(seen) >= n {
+					break
+				}
+				if provider.Addr == nil || seen[provider.Addr.String()] {
+					continue
+				}
+				seen[provider.Addr.String()] = true
+				fresh = append(fresh, provider)
+			}
+			enough := len(seen) >= n
+			mu.Unlock()
+			for _, provider := range fresh {
+				select {
+				case found <- provider:
+				case <-done:
+					return true
+				}
+			}
+			return enough
+		}
+		if emit(s.Values.GetProviders(key)) {
+			return
+		}
+		s.lookup(key, func(peer *Peer) ([]Tuple, bool, error) {
+			providers, closer, err := peer.GetProviders(key)
+			if err != nil {
+				return nil, false, err
+			}
+			return closer, emit(providers), nil
+		})
+	}()
+	return found
+}
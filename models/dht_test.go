@@ -0,0 +1,106 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"kademlia/constants"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetProvidersFitsDatagram(t *testing.T) {
+	s := startTestServer(t, "127.0.0.1")
+	key := ContentKey([]byte("popular"))
+	for _, peer := range testPeers(constants.MAX_PROVIDERS) {
+		s.Values.AddProvider(key, peer.AsTuple(), time.Hour)
+	}
+	for _, peer := range testPeers(3 * s.Table.K) {
+		s.Table.AddPeer(peer)
+	}
+	providers, closer, err := testPeer(s).GetProviders(key)
+	if err != nil {
+		t.Fatalf("get providers: %v", err)
+	}
+	if len(providers) == 0 {
+		t.Fatal("no providers in the answer")
+	}
+	if len(closer) != 0 && len(providers) < constants.MAX_PROVIDERS {
+		t.Fatalf("kept %d contacts but only %d providers", len(closer), len(providers))
+	}
+}
+
+// TestFindProvidersStops checks that a caller can stop reading early
+// without leaving the lookup blocked.
+func TestFindProvidersStops(t *testing.T) {
+	s := newTestServer("127.0.0.1")
+	key := ContentKey([]byte("popular"))
+	for _, peer := range testPeers(5) {
+		s.Values.AddProvider(key, peer.AsTuple(), time.Hour)
+	}
+	done := make(chan struct{})
+	found := s.FindProviders(key, 5, done)
+	<-found
+	close(done)
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := <-found; ok {
+		t.Fatal("FindProviders kept sending after done was closed")
+	}
+}
+
+func TestProviderKeysCapped(t *testing.T) {
+	vs := ValueStore{MaxProvided: 3}
+	provider := testPeers(1)[0].AsTuple()
+	var keys []string
+	for i := 0; i < 4; i++ {
+		keys = append(keys, ContentKey([]byte(fmt.Sprint("key ", i))))
+		err := vs.AddProvider(keys[i], provider, time.Hour)
+		if i < 3 && err != nil {
+			t.Fatal(err)
+		}
+		if i == 3 && !errors.Is(err, ErrStoreFull) {
+			t.Fatalf("providing beyond the limit gave %v", err)
+		}
+	}
+	if err := vs.AddProvider(keys[0], testPeers(2)[1].AsTuple(), time.Hour); err != nil {
+		t.Fatalf("adding a provider to a known key: %v", err)
+	}
+
+	for _, record := range vs.providers[keys[1]] {
+		record.Expires = time.Now().Add(-time.Second)
+	}
+	vs.ExpireProviders()
+	if _, ok := vs.providers[keys[1]]; ok || len(vs.providers) != 2 {
+		t.Fatalf("sweep left %d keys", len(vs.providers))
+	}
+	if err := vs.AddProvider(keys[3], provider, time.Hour); err != nil {
+		t.Fatalf("providing after a key expired: %v", err)
+	}
+}
+
+// TestCacheTTL checks that cached copies expire faster the farther the
+// caching node is from the key compared to the node that held it.
+func TestCacheTTL(t *testing.T) {
+	key := strings.Repeat("0", 40)
+	at := func(distance uint64) *Peer {
+		return &Peer{ID: fmt.Sprintf("%016x", distance) + strings.Repeat("0", 24)}
+	}
+	full := constants.CACHE_TTL * time.Second
+	tests := []struct {
+		holder uint64
+		cache  uint64
+		ttl    time.Duration
+	}{
+		{1 << 40, 1 << 40, full},
+		{1 << 40, 1 << 20, full},
+		{1 << 40, 1 << 41, full / 2},
+		{1 << 40, 1 << 43, full / 8},
+		{1 << 10, 1 << 50, time.Second},
+		{0, 1 << 63, time.Second},
+	}
+	for _, test := range tests {
+		if ttl := cacheTTL(key, at(test.holder), at(test.cache)); ttl != test.ttl {
+			t.Errorf("holder at %x and cache at %x got %s, want %s", test.holder, test.cache, ttl, test.ttl)
+		}
+	}
+}
@@ -0,0 +1,603 @@
+package models
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kademlia/constants"
+	"kademlia/utils"
+	"net"
+	"sync"
+	"time"
+)
+
+// DirectMessage is a message addressed to a single node. It travels over the
+// encrypted session channel; when the recipient can't be reached it is
+// sealed to the recipient's mail key and deposited with the nodes closest to
+// its ID, which hand it over once the recipient asks for its mail from the
+// address its ID belongs to. Sealed messages carry no Body.
+type DirectMessage struct {
+	ID        string `json:"id"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Body      string `json:"body,omitempty"`
+	Ephemeral []byte `json:"ephemeral,omitempty"`
+	Sealed    []byte `json:"sealed,omitempty"`
+	Sent      int64  `json:"sent"`
+}
+
+// sealOverhead is what sealing adds to a body: a GCM nonce and tag.
+const sealOverhead = 12 + 16
+
+var ErrMailboxFull = errors.New("mailbox full")
+
+// MailKey is the X25519 key the mail of Node is sealed to, signed by the
+// identity the node publishes events under so that the nodes holding its
+// mail can't hand out a key of their own.
+type MailKey struct {
+	Node      string            `json:"node"`
+	Key       []byte            `json:"key"`
+	Author    string            `json:"author"`
+	PubKey    ed25519.PublicKey `json:"pub_key"`
+	Signature []byte            `json:"signature"`
+}
+
+func (mk *MailKey) signedData() []byte {
+	return []byte("mail key\x00" + mk.Node + "\x00" + hex.EncodeToString(mk.Key))
+}
+
+// Check verifies that the key is well formed and signed by PubKey.
+func (mk *MailKey) Check() (*ecdh.PublicKey, error) {
+	key, err := ecdh.X25519().NewPublicKey(mk.Key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid mail key", ErrMalformed)
+	}
+	if len(mk.PubKey) != ed25519.PublicKeySize || !ed25519.Verify(mk.PubKey, mk.signedData(), mk.Signature) {
+		return nil, ErrBadSignature
+	}
+	return key, nil
+}
+
+// Verify checks the key and that it was signed by the current key of an
+// author in keys.
+func (mk *MailKey) Verify(keys *TrustStore) (*ecdh.PublicKey, error) {
+	key, err := mk.Check()
+	if err != nil {
+		return nil, err
+	}
+	author := keys.Lookup(mk.Author)
+	if author == nil || !author.Key.Equal(mk.PubKey) {
+		return nil, ErrUnknownAuthor
+	}
+	return key, nil
+}
+
+// Mailbox holds the mail deposited for other nodes, along with the signed
+// keys they collect it with, and the identity this node's own mail key is
+// derived from. At most MAILBOX_MAX messages are held in all.
+type Mailbox struct {
+	mu       sync.Mutex
+	identity *Identity
+	messages map[string][]*DirectMessage
+	keys     map[string]*MailKey
+	held     int
+}
+
+func mailCipher(shared []byte, ephemeral []byte, recipient []byte) (cipher.AEAD, error) {
+	hash := sha256.New()
+	hash.Write(shared)
+	hash.Write(ephemeral)
+	hash.Write(recipient)
+	block, err := aes.NewCipher(hash.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Seal encrypts the body of message to the recipient's mail key with a
+// fresh ephemeral key, so the nodes holding it can't read it.
+func (m *DirectMessage) Seal(key *ecdh.PublicKey) error {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	shared, err := ephemeral.ECDH(key)
+	if err != nil {
+		return err
+	}
+	gcm, err := mailCipher(shared, ephemeral.PublicKey().Bytes(), key.Bytes())
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	m.Ephemeral = ephemeral.PublicKey().Bytes()
+	m.Sealed = gcm.Seal(nonce, nonce, []byte(m.Body), []byte(m.ID+m.To))
+	m.Body = ""
+	return nil
+}
+
+// Open decrypts a message sealed to key.
+func (m *DirectMessage) Open(key *ecdh.PrivateKey) error {
+	ephemeral, err := ecdh.X25519().NewPublicKey(m.Ephemeral)
+	if err != nil {
+		return err
+	}
+	shared, err := key.ECDH(ephemeral)
+	if err != nil {
+		return err
+	}
+	gcm, err := mailCipher(shared, m.Ephemeral, key.PublicKey().Bytes())
+	if err != nil {
+		return err
+	}
+	if len(m.Sealed) < gcm.NonceSize() {
+		return ErrMalformed
+	}
+	nonce, sealed := m.Sealed[:gcm.NonceSize()], m.Sealed[gcm.NonceSize():]
+	body, err := gcm.Open(nil, nonce, sealed, []byte(m.ID+m.To))
+	if err != nil {
+		return err
+	}
+	m.Body = string(body)
+	m.Ephemeral, m.Sealed = nil, nil
+	return nil
+}
+
+// SetIdentity sets the identity this node's mail key is derived from and
+// signed with. Without one a random identity is generated, which nobody
+// trusts, so no mail is left for the node.
+func (mb *Mailbox) SetIdentity(identity *Identity) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.identity = identity
+}
+
+func (mb *Mailbox) ownIdentity() (*Identity, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if mb.identity == nil {
+		identity, err := NewIdentity()
+		if err != nil {
+			return nil, err
+		}
+		mb.identity = identity
+	}
+	return mb.identity, nil
+}
+
+func (mb *Mailbox) Key() (*ecdh.PrivateKey, error) {
+	identity, err := mb.ownIdentity()
+	if err != nil {
+		return nil, err
+	}
+	return identity.MailKey()
+}
+
+// signedKey returns this node's mail key for node, signed by its identity.
+func (mb *Mailbox) signedKey(node string) (*MailKey, error) {
+	identity, err := mb.ownIdentity()
+	if err != nil {
+		return nil, err
+	}
+	return identity.SignMailKey(node)
+}
+
+func (mb *Mailbox) setKey(to string, key *MailKey) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if mb.keys == nil {
+		mb.keys = make(map[string]*MailKey)
+	}
+	mb.keys[to] = key
+}
+
+func (mb *Mailbox) keyOf(to string) *MailKey {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	return mb.keys[to]
+}
+
+func (mb *Mailbox) expire(to string) {
+	var live []*DirectMessage
+	for _, message := range mb.messages[to] {
+		if time.Since(time.Unix(message.Sent, 0)) <= constants.MAILBOX_TTL*time.Second {
+			live = append(live, message)
+		}
+	}
+	mb.held -= len(mb.messages[to]) - len(live)
+	if len(live) == 0 {
+		delete(mb.messages, to)
+		return
+	}
+	mb.messages[to] = live
+}
+
+// Expire drops the expired messages held for every recipient.
+func (mb *Mailbox) Expire() {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	for to := range mb.messages {
+		mb.expire(to)
+	}
+}
+
+func (mb *Mailbox) Deposit(message *DirectMessage) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if mb.messages == nil {
+		mb.messages = make(map[string][]*DirectMessage)
+	}
+	mb.expire(message.To)
+	for _, held := range mb.messages[message.To] {
+		if held.ID == message.ID {
+			return nil
+		}
+	}
+	if len(mb.messages[message.To]) >= constants.MAILBOX_SIZE {
+		return ErrMailboxFull
+	}
+	if mb.held >= constants.MAILBOX_MAX {
+		for to := range mb.messages {
+			mb.expire(to)
+		}
+		if mb.held >= constants.MAILBOX_MAX {
+			return ErrMailboxFull
+		}
+	}
+	mb.messages[message.To] = append(mb.messages[message.To], message)
+	mb.held += 1
+	return nil
+}
+
+// Collect returns up to n messages held for to. They are kept until the
+// recipient acknowledges them with Ack.
+func (mb *Mailbox) Collect(to string, n int) []*DirectMessage {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.expire(to)
+	held := mb.messages[to]
+	if len(held) > n {
+		held = held[:n]
+	}
+	return append([]*DirectMessage{}, held...)
+}
+
+// Ack removes the messages with the given IDs held for to.
+func (mb *Mailbox) Ack(to string, ids []string) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	acked := make(map[string]bool)
+	for _, id := range ids {
+		acked[id] = true
+	}
+	var kept []*DirectMessage
+	for _, message := range mb.messages[to] {
+		if !acked[message.ID] {
+			kept = append(kept, message)
+		}
+	}
+	mb.held -= len(mb.messages[to]) - len(kept)
+	if len(kept) == 0 {
+		delete(mb.messages, to)
+		return
+	}
+	mb.messages[to] = kept
+}
+
+func (p *Peer) Direct(message *DirectMessage) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	msgType, _, _, err := p.SendRecv("direct", data)
+	if err != nil {
+		return err
+	}
+	if msgType != "delivered" {
+		return errors.New("message was not delivered")
+	}
+	return nil
+}
+
+func (p *Peer) Deposit(message *DirectMessage) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	msgType, reply, _, err := p.SendRecv("deposit", data)
+	if err != nil {
+		return err
+	}
+	if msgType != "deposited" {
+		return rejected(reply)
+	}
+	return nil
+}
+
+// Collect asks for the mail held for this node, registering key as the
+// one to seal further mail to.
+func (p *Peer) Collect(key *MailKey) ([]*DirectMessage, error) {
+	request, err := json.Marshal(key)
+	if err != nil {
+		return nil, err
+	}
+	msgType, data, _, err := p.SendRecv("collect", request)
+	if err != nil {
+		return nil, err
+	}
+	if msgType != "mail" {
+		return nil, unexpected(msgType)
+	}
+	var messages []*DirectMessage
+	err = decode(data, &messages)
+	return messages, err
+}
+
+// Ack tells the peer that the messages with ids were collected, so it can
+// delete them.
+func (p *Peer) Ack(ids []string) error {
+	data, err := json.Marshal(ids)
+	if err != nil {
+		return err
+	}
+	msgType, _, _, err := p.SendRecv("collected", data)
+	if err != nil {
+		return err
+	}
+	if msgType != "acked" {
+		return unexpected(msgType)
+	}
+	return nil
+}
+
+// MailKey asks the peer for the mail key the node with id registered with
+// it.
+func (p *Peer) MailKey(id string) (*MailKey, error) {
+	msgType, data, _, err := p.SendRecv("mail key", []byte(id))
+	if err != nil {
+		return nil, err
+	}
+	if msgType != "mail key" {
+		return nil, ErrNotFound
+	}
+	var key MailKey
+	err = decode(data, &key)
+	return &key, err
+}
+
+func (s *Server) findPeer(id string) *Peer {
+	if peer := s.Table.FindPeer(id); peer != nil {
+		return peer
+	}
+	for _, peer := range s.Lookup(id) {
+		if peer.ID == id {
+			return peer
+		}
+	}
+	return nil
+}
+
+// SendDirect sends body to the node with the given ID and reports whether it
+// acknowledged delivery. If it can't be reached the message is left in the
+// DHT for it to collect later; an error means no node would hold it either.
+func (s *Server) SendDirect(to string, body string) (bool, error) {
+	if len(body) > constants.MAX_VALUE_SIZE {
+		return false, ErrValueTooBig
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return false, err
+	}
+	message := &DirectMessage{
+		ID:   hex.EncodeToString(id),
+		From: s.ID,
+		To:   to,
+		Body: body,
+		Sent: time.Now().Unix(),
+	}
+	if peer := s.findPeer(to); peer != nil && peer.Direct(message) == nil {
+		return true, nil
+	}
+	key, err := s.mailKey(to)
+	if err != nil {
+		return false, err
+	}
+	if err := message.Seal(key); err != nil {
+		return false, err
+	}
+	stored := s.replicate(to, func(peer *Peer) error {
+		if peer.ID == to {
+			return errors.New("recipient is unreachable")
+		}
+		return peer.Deposit(message)
+	})
+	if stored == 0 {
+		return false, fmt.Errorf("could not deliver or store message for %s", to)
+	}
+	return false, nil
+}
+
+// mailKey finds the mail key of the node with id from the nodes holding its
+// mail, accepting only keys signed by a trusted author.
+func (s *Server) mailKey(id string) (*ecdh.PublicKey, error) {
+	for _, peer := range s.Lookup(id) {
+		signed, err := peer.MailKey(id)
+		if err != nil || signed.Node != id {
+			continue
+		}
+		if key, err := signed.Verify(s.Events.Keys); err == nil {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("no mail key known for %s", id)
+}
+
+func (s *Server) receiveDirect(message *DirectMessage) {
+	if !s.Gossip.MarkSeen(message.ID) {
+		return
+	}
+	s.emit(&Event{Kind: "direct", Author: message.From, Data: message.Body, Hash: message.ID})
+}
+
+// CollectMail fetches the messages left for this node while it was offline
+// from the nodes closest to its ID, acknowledging each batch once it is
+// read. Messages that can't be opened are acknowledged too, since they
+// never will be.
+func (s *Server) CollectMail() int {
+	key, err := s.Mail.Key()
+	if err != nil {
+		return 0
+	}
+	signed, err := s.Mail.signedKey(s.ID)
+	if err != nil {
+		return 0
+	}
+	collected := 0
+	for _, peer := range s.Lookup(s.ID) {
+		for {
+			messages, err := peer.Collect(signed)
+			if err != nil || len(messages) == 0 {
+				break
+			}
+			var ids []string
+			for _, message := range messages {
+				ids = append(ids, message.ID)
+				if message.To != s.ID {
+					continue
+				}
+				if err := message.Open(key); err != nil {
+					s.logger("mail").Warn("unreadable mail", "peer", peer.ID, "from", message.From, "err", err)
+					continue
+				}
+				s.receiveDirect(message)
+				collected += 1
+			}
+			if peer.Ack(ids) != nil {
+				break
+			}
+		}
+	}
+	return collected
+}
+
+func (s *Server) mailLoop() {
+	for {
+		s.Mail.Expire()
+		if collected := s.CollectMail(); collected > 0 {
+			s.logger("mail").Info("collected mail", "messages", collected)
+		}
+		time.Sleep(constants.MAILBOX_INTERVAL * time.Second)
+	}
+}
+
+func (s *Server) handleDirect(addr *net.UDPAddr, key []byte, data []byte) {
+	var message DirectMessage
+	if err := decode(data, &message); err != nil {
+		s.fault(addr, err)
+		return
+	}
+	if message.To != s.ID {
+		s.Send(addr, key, "rejected", []byte("wrong recipient"))
+		return
+	}
+	message.From = NodeID(addr.IP)
+	s.Send(addr, key, "delivered", []byte(""))
+	s.receiveDirect(&message)
+}
+
+func (s *Server) handleDeposit(addr *net.UDPAddr, key []byte, data []byte) {
+	var message DirectMessage
+	if err := decode(data, &message); err != nil {
+		s.fault(addr, err)
+		return
+	}
+	if !ValidKey(message.To) || !s.responsible(message.To) {
+		s.Send(addr, key, "rejected", []byte("not a holder of mail for "+message.To))
+		return
+	}
+	message.From = NodeID(addr.IP)
+	if message.Sent > time.Now().Unix() {
+		message.Sent = time.Now().Unix()
+	}
+	if message.Body != "" || len(message.Sealed) == 0 {
+		s.Send(addr, key, "rejected", []byte("mail must be sealed"))
+		return
+	}
+	if len(message.Sealed) > constants.MAX_VALUE_SIZE+sealOverhead {
+		s.Send(addr, key, "rejected", []byte(ErrValueTooBig.Error()))
+		return
+	}
+	if err := s.Mail.Deposit(&message); err != nil {
+		s.Send(addr, key, "rejected", []byte(err.Error()))
+		return
+	}
+	s.Send(addr, key, "deposited", []byte(""))
+}
+
+// handleCollect hands over the mail held for the node the request comes
+// from, as much as fits in one datagram, and records the mail key it sent.
+func (s *Server) handleCollect(addr *net.UDPAddr, key []byte, data []byte) {
+	var mailKey MailKey
+	if err := decode(data, &mailKey); err != nil {
+		s.fault(addr, err)
+		return
+	}
+	if _, err := mailKey.Check(); err != nil || mailKey.Node != NodeID(addr.IP) {
+		s.fault(addr, fmt.Errorf("%w: invalid mail key", ErrMalformed))
+		return
+	}
+	s.Mail.setKey(NodeID(addr.IP), &mailKey)
+	messages := s.Mail.Collect(NodeID(addr.IP), 1)
+	msg, err := json.Marshal(messages)
+	if err != nil {
+		return
+	}
+	s.Send(addr, key, "mail", msg)
+}
+
+func (s *Server) handleCollected(addr *net.UDPAddr, key []byte, data []byte) {
+	var ids []string
+	if err := decode(data, &ids); err != nil {
+		s.fault(addr, err)
+		return
+	}
+	s.Mail.Ack(NodeID(addr.IP), ids)
+	s.Send(addr, key, "acked", []byte(""))
+}
+
+func (s *Server) handleMailKey(addr *net.UDPAddr, key []byte, data []byte) {
+	mailKey := s.Mail.keyOf(string(data))
+	if mailKey == nil {
+		s.Send(addr, key, "missing", []byte(""))
+		return
+	}
+	msg, err := json.Marshal(mailKey)
+	if err != nil {
+		return
+	}
+	s.Send(addr, key, "mail key", msg)
+}
+
+// responsible reports whether this node is among the replicas nodes closest
+// to id that it knows of, not counting the node with id itself.
+func (s *Server) responsible(id string) bool {
+	distance := utils.Distance(s.ID, id)
+	closer := 0
+	for _, peer := range s.Table.ListPeers() {
+		if peer.ID != id && utils.Distance(peer.ID, id) < distance {
+			closer += 1
+		}
+	}
+	return closer < s.replicas(s.NetworkSize().Estimate)
+}
@@ -0,0 +1,159 @@
+package models
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"kademlia/constants"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestSealedMail deposits a message for an offline node and collects it.
+// Requests in these tests all come from 127.0.0.1, so that is where the
+// recipient lives.
+func TestSealedMail(t *testing.T) {
+	holder := startTestServer(t, "127.0.0.2")
+	recipient := newTestServer("127.0.0.1")
+	recipient.Table.AddPeer(testPeer(holder))
+	identity, _ := NewIdentity()
+	recipient.Mail.SetIdentity(identity)
+	if recipient.CollectMail() != 0 {
+		t.Fatal("collected mail from an empty mailbox")
+	}
+
+	sender := newTestServer("127.0.0.3")
+	sender.Table.AddPeer(testPeer(holder))
+	if _, err := sender.SendDirect(recipient.ID, "meet at noon"); err == nil {
+		t.Fatal("sealed mail to a key signed by an untrusted identity")
+	}
+	sender.Events.Keys = &TrustStore{}
+	sender.Events.Keys.AddIdentity(identity.ID, identity.PublicKey(), false)
+	delivered, err := sender.SendDirect(recipient.ID, "meet at noon")
+	if err != nil || delivered {
+		t.Fatalf("send gave %v, %v", delivered, err)
+	}
+	held := holder.Mail.Collect(recipient.ID, 10)
+	if len(held) != 1 || held[0].Body != "" || bytes.Contains(held[0].Sealed, []byte("noon")) {
+		t.Fatalf("holder keeps %+v", held)
+	}
+
+	// Collecting without acknowledging leaves the message with the holder.
+	signed, _ := identity.SignMailKey(recipient.ID)
+	if _, err := testPeer(holder).Collect(signed); err != nil {
+		t.Fatal(err)
+	}
+	if len(holder.Mail.Collect(recipient.ID, 10)) != 1 {
+		t.Fatal("message deleted before it was acknowledged")
+	}
+
+	events := recipient.Subscribe(EventFilter{Kind: "direct"})
+	if recipient.CollectMail() != 1 {
+		t.Fatal("message not collected")
+	}
+	select {
+	case event := <-events:
+		if event.Data != "meet at noon" {
+			t.Fatalf("opened %q", event.Data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("collected message not delivered")
+	}
+	if len(holder.Mail.Collect(recipient.ID, 10)) != 0 {
+		t.Fatal("acknowledged message still held")
+	}
+}
+
+func TestUnsealedMailRejected(t *testing.T) {
+	holder := startTestServer(t, "127.0.0.2")
+	message := &DirectMessage{ID: "1", To: NodeID(holder.Addr.IP), Body: "plain", Sent: time.Now().Unix()}
+	if err := testPeer(holder).Deposit(message); err == nil {
+		t.Fatal("holder accepted an unsealed message")
+	}
+	other, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	key, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	if err := message.Seal(key.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	if err := message.Open(other); err == nil {
+		t.Fatal("opened a message sealed to another key")
+	}
+	if err := message.Open(key); err != nil || message.Body != "plain" {
+		t.Fatalf("opening gave %q, %v", message.Body, err)
+	}
+}
+
+// TestForgedMailKey has a holder hand out its own mail key for the
+// recipient; the sender must not seal mail to it.
+func TestForgedMailKey(t *testing.T) {
+	holder := startTestServer(t, "127.0.0.2")
+	recipient := newTestServer("127.0.0.1")
+	identity, _ := NewIdentity()
+	recipient.Mail.SetIdentity(identity)
+
+	forger, _ := NewIdentity()
+	forged, _ := forger.SignMailKey(recipient.ID)
+	forged.Author = identity.ID
+	holder.Mail.setKey(recipient.ID, forged)
+
+	sender := newTestServer("127.0.0.3")
+	sender.Events.Keys = &TrustStore{}
+	sender.Events.Keys.AddIdentity(identity.ID, identity.PublicKey(), false)
+	sender.Table.AddPeer(testPeer(holder))
+	if _, err := sender.mailKey(recipient.ID); err == nil {
+		t.Fatal("accepted a mail key signed by another identity")
+	}
+
+	recipient.Table.AddPeer(testPeer(holder))
+	recipient.CollectMail()
+	key, err := sender.mailKey(recipient.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	own, _ := identity.MailKey()
+	if !key.Equal(own.PublicKey()) {
+		t.Fatal("got another key than the recipient's")
+	}
+}
+
+func TestDepositLimits(t *testing.T) {
+	holder := startTestServer(t, "127.0.0.2")
+	peer := testPeer(holder)
+	key, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	sealed := func(to string) *DirectMessage {
+		message := &DirectMessage{ID: to, To: to, Body: "hello", Sent: time.Now().Unix()}
+		message.Seal(key.PublicKey())
+		return message
+	}
+	if err := peer.Deposit(sealed("not a node")); err == nil {
+		t.Fatal("deposit for an invalid recipient accepted")
+	}
+
+	to := NodeID(net.ParseIP("10.0.0.1"))
+	for i := 0; i < holder.Table.K; i++ {
+		closer := Tuple{Addr: &net.UDPAddr{IP: net.IPv4(10, 1, 0, byte(i)), Port: 4444}}.AsPeer()
+		closer.ID = to[:12] + fmt.Sprintf("%02x", i) + to[14:]
+		holder.Table.AddPeer(closer)
+	}
+	if err := peer.Deposit(sealed(to)); err == nil {
+		t.Fatal("deposit for a recipient other nodes are closer to accepted")
+	}
+
+	var mailbox Mailbox
+	for i := 0; i < constants.MAILBOX_MAX; i++ {
+		message := &DirectMessage{ID: fmt.Sprint(i), To: fmt.Sprint(i % 1000), Sent: time.Now().Unix()}
+		if err := mailbox.Deposit(message); err != nil {
+			t.Fatalf("deposit %d: %v", i, err)
+		}
+	}
+	if err := mailbox.Deposit(&DirectMessage{ID: "full", To: "another", Sent: time.Now().Unix()}); !errors.Is(err, ErrMailboxFull) {
+		t.Fatalf("deposit past the cap gave %v", err)
+	}
+	mailbox.messages["7"][0].Sent = time.Now().Add(-2 * constants.MAILBOX_TTL * time.Second).Unix()
+	if err := mailbox.Deposit(&DirectMessage{ID: "full", To: "another", Sent: time.Now().Unix()}); err != nil {
+		t.Fatalf("deposit after a message expired gave %v", err)
+	}
+}
@@ -0,0 +1,93 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"kademlia/utils"
+	"net"
+	"sync"
+)
+
+var (
+	ErrBadSignature = errors.New("bad signature")
+	ErrStaleRecord  = errors.New("stale sequence number")
+	ErrValueTooBig  = errors.New("value too big")
+	ErrHashMismatch = errors.New("value does not match its key")
+	ErrStoreFull    = errors.New("value store full")
+	ErrNotFound     = errors.New("value not found")
+	ErrBadHash      = errors.New("hash does not match contents")
+	ErrPowFailed    = errors.New("nonce does not meet difficulty")
+	ErrBadLink      = errors.New("event does not extend its parent")
+	ErrUnknownPrev  = errors.New("event extends an unknown event")
+	ErrDuplicate    = errors.New("event already in chain")
+
+	ErrTimeout         = errors.New("timed out waiting for reply")
+	ErrMalformed       = errors.New("malformed message")
+	ErrKeyExchange     = errors.New("key exchange failed")
+	ErrUnexpectedReply = errors.New("unexpected reply")
+	ErrRejected        = errors.New("request rejected")
+	ErrBlacklisted     = errors.New("peer is blacklisted")
+)
+
+// dropReasons classifies why a request was dropped, most specific first.
+var dropReasons = []error{
+	ErrBlacklisted,
+	ErrTimeout,
+	ErrPowFailed,
+	ErrKeyExchange,
+	utils.ErrDecrypt,
+	utils.ErrBadKey,
+	ErrMalformed,
+}
+
+// Drops counts the requests the server dropped by reason and keeps the
+// most recent error.
+type Drops struct {
+	mu     sync.Mutex
+	counts map[string]int
+	Last   error
+}
+
+func dropReason(err error) string {
+	for _, reason := range dropReasons {
+		if errors.Is(err, reason) {
+			return reason.Error()
+		}
+	}
+	return "other"
+}
+
+func (d *Drops) Counts() map[string]int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	counts := make(map[string]int)
+	for reason, count := range d.counts {
+		counts[reason] = count
+	}
+	return counts
+}
+
+// fault drops a request that is provably the sender's fault, because it
+// came after a key exchange from the address that made it, and raises the
+// difficulty the sender faces.
+func (s *Server) fault(addr *net.UDPAddr, err error) {
+	s.drop(addr, err)
+	s.Admission.Failure(NodeID(addr.IP))
+}
+
+func (s *Server) drop(addr *net.UDPAddr, err error) {
+	s.Drops.mu.Lock()
+	defer s.Drops.mu.Unlock()
+	if s.Drops.counts == nil {
+		s.Drops.counts = make(map[string]int)
+	}
+	reason := dropReason(err)
+	s.Drops.counts[reason] += 1
+	if addr != nil {
+		s.logger("server").Debug("dropped request", "peer", NodeID(addr.IP), "reason", reason, "err", err)
+		err = fmt.Errorf("%s: %w", addr, err)
+	} else {
+		s.logger("server").Debug("dropped request", "reason", reason, "err", err)
+	}
+	s.Drops.Last = err
+}
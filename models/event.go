@@ -1,10 +1,38 @@
 package models
 
+import "strconv"
+
 type Event struct {
-	Data      string
-	Signature []byte
-	Hash      string
-	Prev      *Event
-	Nonce     int
-	Next      *Event
+	Data      string `json:"data"`
+	Kind      string `json:"kind,omitempty"`
+	Topic     string `json:"topic,omitempty"`
+	Time      int64  `json:"time,omitempty"`
+	Author    string `json:"author"`
+	Signature []byte `json:"signature"`
+	Hash      string `json:"hash"`
+	PrevHash  string `json:"prev_hash"`
+	Height    int    `json:"height"`
+	Prev      *Event `json:"-"`
+	Nonce     int    `json:"nonce"`
+	Work      uint64 `json:"-"`
+}
+
+// SignedData is what the author signs: the data alone for plain messages,
+// prefixed by the kind and topic otherwise so that an event can't be
+// replayed as a different kind or onto a different topic. Topic events also
+// cover the time they were published at, so they can't be replayed later.
+func (e *Event) SignedData() []byte {
+	if e.Kind == "" && e.Topic == "" {
+		return []byte(e.Data)
+	}
+	if e.Topic != "" {
+		return []byte(e.Kind + "\x00" + e.Topic + "\x00" + strconv.FormatInt(e.Time, 10) + "\x00" + e.Data)
+	}
+	return []byte(e.Kind + "\x00" + e.Topic + "\x00" + e.Data)
+}
+
+type Reorg struct {
+	Ancestor *Event
+	Removed  []*Event
+	Added    []*Event
 }
@@ -7,79 +7,437 @@ import (
 	"fmt"
 	"io"
 	"kademlia/utils"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
+var genesisHash = strings.Repeat("0", 40)
+
+// EventChain is a tree of events that follows its heaviest branch. With a
+// Store, events and the canonical chain are read back from it and only the
+// events added since startup are held in memory.
 type EventChain struct {
-	Head       *Event
-	Difficulty int
+	Difficulty  int
+	Keys        *TrustStore
+	Store       *EventStore
+	mu          sync.Mutex
+	tip         *Event
+	events      map[string]*Event
+	canonical   []*Event
+	subscribers []chan Reorg
 }
 
-func (ec *EventChain) Mine(event *Event) {
-	minInt, maxInt := utils.GetTargetRange(40, ec.Difficulty)
+func (ec *EventChain) hash(event *Event, nonce int) []byte {
 	hashData := append([]byte(event.Data), event.Signature...)
-	if event.Prev != nil {
-		hashData = append(hashData, []byte(event.Prev.Hash)...)
+	if event.PrevHash != "" {
+		hashData = append(hashData, []byte(event.PrevHash)...)
 	} else {
-		hashData = append(hashData, []byte(strings.Repeat("0", 40))...)
+		hashData = append(hashData, []byte(genesisHash)...)
 	}
+	hash := sha1.New()
+	io.WriteString(hash, string(hashData)+strconv.Itoa(nonce))
+	return hash.Sum(nil)
+}
 
+func (ec *EventChain) Mine(event *Event) {
+	start := time.Now()
+	minInt, maxInt := utils.GetTargetRange(40, ec.Difficulty)
 	nonce := 0
 	for {
-		hash := sha1.New()
-		io.WriteString(hash, string(hashData)+strconv.Itoa(nonce))
-		h := binary.BigEndian.Uint64(hash.Sum(nil))
+		sum := ec.hash(event, nonce)
+		h := binary.BigEndian.Uint64(sum)
 		if minInt < h && h < maxInt {
-			event.Hash = hex.EncodeToString(hash.Sum(nil))
+			event.Hash = hex.EncodeToString(sum)
 			event.Nonce = nonce
+			DefaultMetrics.Since("kademlia_pow_mining_seconds", "", start)
 			return
 		}
 		nonce += 1
 	}
 }
 
-func (ec *EventChain) Append(event *Event) {
-	if ec.Head == nil {
-		ec.Head = event
-		ec.Mine(event)
+// verify checks that event is signed by a key authorized on the branch
+// ending in prev, carries a correctly mined hash and extends prev, which is
+// nil for the first event of the chain.
+func (ec *EventChain) verify(event *Event, prev *Event) error {
+	if err := ec.branchKeys(prev).Verify(event); err != nil {
+		return fmt.Errorf("event %d: %w", event.Height, err)
+	}
+	sum := ec.hash(event, event.Nonce)
+	if hex.EncodeToString(sum) != event.Hash {
+		return fmt.Errorf("event %d: %w", event.Height, ErrBadHash)
+	}
+	minInt, maxInt := utils.GetTargetRange(40, ec.Difficulty)
+	h := binary.BigEndian.Uint64(sum)
+	if !(minInt < h && h < maxInt) {
+		return fmt.Errorf("event %d: %w", event.Height, ErrPowFailed)
+	}
+	if prev == nil {
+		if event.Height != 0 || (event.PrevHash != "" && event.PrevHash != genesisHash) {
+			return fmt.Errorf("event %d: %w", event.Height, ErrBadLink)
+		}
+		return nil
+	}
+	if event.PrevHash != prev.Hash || event.Height != prev.Height+1 {
+		return fmt.Errorf("event %d: %w", event.Height, ErrBadLink)
+	}
+	return nil
+}
+
+// Validate checks a mined event received from another node against the
+// event it extends.
+func (ec *EventChain) Validate(event *Event) error {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	_, err := ec.validate(event)
+	return err
+}
+
+func (ec *EventChain) validate(event *Event) (*Event, error) {
+	if ec.lookup(event.Hash) != nil {
+		return nil, ErrDuplicate
+	}
+	var prev *Event
+	if event.PrevHash != "" && event.PrevHash != genesisHash {
+		prev = ec.lookup(event.PrevHash)
+		if prev == nil {
+			return nil, fmt.Errorf("event %d: %w", event.Height, ErrUnknownPrev)
+		}
+	}
+	return prev, ec.verify(event, prev)
+}
+
+// lookup finds a known event in memory or, failing that, in Store.
+func (ec *EventChain) lookup(hash string) *Event {
+	if event, ok := ec.events[hash]; ok {
+		return event
+	}
+	if ec.Store == nil {
+		return nil
+	}
+	event, err := ec.Store.Get(hash)
+	if err != nil {
+		return nil
+	}
+	event.Work = ec.work() * uint64(event.Height+1)
+	return event
+}
+
+// canonicalAt returns the event at height on the canonical chain.
+func (ec *EventChain) canonicalAt(height int) *Event {
+	if ec.Store == nil {
+		if height < 0 || height >= len(ec.canonical) {
+			return nil
+		}
+		return ec.canonical[height]
+	}
+	hash := ec.Store.CanonicalHash(height)
+	if hash == "" {
+		return nil
+	}
+	return ec.lookup(hash)
+}
+
+func (ec *EventChain) isCanonical(event *Event) bool {
+	if ec.Store == nil {
+		return event.Height < len(ec.canonical) && ec.canonical[event.Height] == event
+	}
+	return ec.Store.CanonicalHash(event.Height) == event.Hash
+}
+
+// Add inserts an event mined by another node after validating it. Events
+// may extend any known event, not just the current tip; the chain follows
+// whichever branch carries the most cumulative work.
+func (ec *EventChain) Add(event *Event) error {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	prev, err := ec.validate(event)
+	if err != nil {
+		return err
+	}
+	return ec.insert(event, prev)
+}
+
+func (ec *EventChain) Append(event *Event) error {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	prev := ec.tip
+	if prev == nil {
+		event.Height = 0
+		event.PrevHash = genesisHash
 	} else {
-		current := ec.Head
-		for {
-			if current.Next == nil {
-				event.Prev = current
-				current.Next = event
-				ec.Mine(event)
-				return
-			}
-			current = current.Next
+		event.Height = prev.Height + 1
+		event.PrevHash = prev.Hash
+	}
+	ec.Mine(event)
+	return ec.insert(event, prev)
+}
+
+// Load picks up the chain from Store where it was left: only the head is
+// read, the rest is read from Store when needed.
+func (ec *EventChain) Load() error {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	length := ec.Store.Len()
+	if length == 0 {
+		return nil
+	}
+	head := ec.lookup(ec.Store.CanonicalHash(length - 1))
+	if head == nil {
+		return fmt.Errorf("head at height %d: %w", length-1, ErrNotFound)
+	}
+	ec.tip = head
+	ec.rebuildTrust()
+	return nil
+}
+
+func (ec *EventChain) work() uint64 {
+	return 1 << (4 * uint(ec.Difficulty))
+}
+
+func (ec *EventChain) insert(event *Event, prev *Event) error {
+	if ec.Store != nil {
+		if err := ec.Store.Append(event); err != nil {
+			return err
 		}
 	}
+	ec.link(event, prev)
+	return nil
 }
 
-func (ec *EventChain) Last() *Event {
-	if ec.Head == nil {
+func (ec *EventChain) link(event *Event, prev *Event) {
+	if ec.events == nil {
+		ec.events = make(map[string]*Event)
+	}
+	event.Prev = prev
+	event.Work = ec.work()
+	if prev != nil {
+		event.Work += prev.Work
+	}
+	ec.events[event.Hash] = event
+	if ec.tip == nil || event.Work > ec.tip.Work {
+		ec.setTip(event)
+	}
+}
+
+// prevOf returns the event that event extends, or nil for the first one.
+func (ec *EventChain) prevOf(event *Event) *Event {
+	if event.Prev != nil {
+		return event.Prev
+	}
+	if event.PrevHash == "" || event.PrevHash == genesisHash {
 		return nil
 	}
-	current := ec.Head
-	for {
-		if current.Next == nil {
-			return current
+	return ec.lookup(event.PrevHash)
+}
+
+// setTip makes the branch ending in tip canonical from its common ancestor
+// with the current one on, and notifies subscribers if events were taken
+// off the canonical chain.
+func (ec *EventChain) setTip(tip *Event) {
+	old := ec.tip
+	var added []*Event
+	ancestor := tip
+	for ancestor != nil && (old == nil || ancestor.Height > old.Height || !ec.isCanonical(ancestor)) {
+		added = append([]*Event{ancestor}, added...)
+		ancestor = ec.prevOf(ancestor)
+	}
+	from := 0
+	if ancestor != nil {
+		from = ancestor.Height + 1
+	}
+	var removed []*Event
+	if old != nil {
+		for height := from; height <= old.Height; height++ {
+			if event := ec.canonicalAt(height); event != nil {
+				removed = append(removed, event)
+			}
+		}
+	}
+
+	if ec.Store == nil {
+		ec.canonical = append(ec.canonical[:from], added...)
+	} else {
+		hashes := make([]string, len(added))
+		for i, event := range added {
+			hashes[i] = event.Hash
+		}
+		if err := ec.Store.SetCanonical(from, hashes); err != nil {
+			return
+		}
+	}
+	ec.tip = tip
+	if len(removed) > 0 {
+		ec.rebuildTrust()
+	} else {
+		for _, event := range added {
+			ec.Keys.Apply(event)
+		}
+	}
+
+	if len(removed) > 0 {
+		reorg := Reorg{Ancestor: ancestor, Removed: removed, Added: added}
+		for _, subscriber := range ec.subscribers {
+			select {
+			case subscriber <- reorg:
+			default:
+			}
 		}
-		current = current.Next
 	}
 }
 
-func (ec *EventChain) Print() {
-	if ec.Head == nil {
+// rebuildTrust goes back to the configured keys and replays the trust
+// events of the canonical chain, dropping those of abandoned branches.
+func (ec *EventChain) rebuildTrust() {
+	if ec.Keys == nil {
 		return
 	}
-	current := ec.Head
-	for {
-		fmt.Println(current.Hash)
-		if current.Next == nil {
-			return
+	ec.Keys.reset()
+	if ec.tip != nil {
+		ec.replayTrust(ec.Keys, ec.tip.Height)
+	}
+}
+
+// replayTrust applies to keys the trust events of the canonical chain up to
+// and including height.
+func (ec *EventChain) replayTrust(keys *TrustStore, height int) {
+	if ec.Store == nil {
+		for _, event := range ec.canonical {
+			if event.Height > height {
+				break
+			}
+			keys.Apply(event)
+		}
+		return
+	}
+	for _, hash := range ec.Store.TrustHashes() {
+		if event := ec.lookup(hash); event != nil && event.Height <= height && ec.isCanonical(event) {
+			keys.Apply(event)
+		}
+	}
+}
+
+// branchKeys returns the keys trusted after prev: those of the canonical
+// chain when prev is its tip, otherwise the configured keys with the trust
+// events of the branch ending in prev replayed on top.
+func (ec *EventChain) branchKeys(prev *Event) *TrustStore {
+	if ec.Keys == nil || (prev != nil && ec.tip != nil && prev.Hash == ec.tip.Hash) {
+		return ec.Keys
+	}
+	keys := ec.Keys.fork()
+	var side []*Event
+	ancestor := prev
+	for ancestor != nil && !ec.isCanonical(ancestor) {
+		side = append([]*Event{ancestor}, side...)
+		ancestor = ec.prevOf(ancestor)
+	}
+	if ancestor != nil {
+		ec.replayTrust(keys, ancestor.Height)
+	}
+	for _, event := range side {
+		keys.Apply(event)
+	}
+	return keys
+}
+
+// SubscribeReorgs returns a channel that receives a Reorg every time the
+// canonical chain switches to a heavier branch. Notifications are dropped
+// if the channel is not drained.
+func (ec *EventChain) SubscribeReorgs() <-chan Reorg {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	subscriber := make(chan Reorg, 16)
+	ec.subscribers = append(ec.subscribers, subscriber)
+	return subscriber
+}
+
+func (ec *EventChain) Get(hash string) *Event {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	return ec.lookup(hash)
+}
+
+// Hashes returns the sorted hashes of every known event, including those on
+// side branches.
+func (ec *EventChain) Hashes() []string {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	if ec.Store != nil {
+		return ec.Store.Hashes()
+	}
+	var hashes []string
+	for hash := range ec.events {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	return hashes
+}
+
+func (ec *EventChain) Last() *Event {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	return ec.tip
+}
+
+func (ec *EventChain) Len() int {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	if ec.tip == nil {
+		return 0
+	}
+	return ec.tip.Height + 1
+}
+
+func (ec *EventChain) At(height int) *Event {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	return ec.canonicalAt(height)
+}
+
+// Range returns copies of the events with heights in [from, to], detached
+// from the chain so they can be sent to other peers.
+func (ec *EventChain) Range(from int, to int) []*Event {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	if from < 0 {
+		from = 0
+	}
+	last := -1
+	if ec.tip != nil {
+		last = ec.tip.Height
+	}
+	if to > last {
+		to = last
+	}
+	var events []*Event
+	for height := from; height <= to; height++ {
+		current := ec.canonicalAt(height)
+		if current == nil {
+			break
+		}
+		events = append(events, &Event{
+			Data:      current.Data,
+			Kind:      current.Kind,
+			Topic:     current.Topic,
+			Time:      current.Time,
+			Author:    current.Author,
+			Signature: current.Signature,
+			Hash:      current.Hash,
+			PrevHash:  current.PrevHash,
+			Height:    current.Height,
+			Nonce:     current.Nonce,
+		})
+	}
+	return events
+}
+
+func (ec *EventChain) Print() {
+	for height := 0; height < ec.Len(); height++ {
+		if event := ec.At(height); event != nil {
+			fmt.Println(event.Hash)
 		}
-		current = current.Next
 	}
 }
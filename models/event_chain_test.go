@@ -0,0 +1,250 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testChain(t *testing.T, identity *Identity, dir string) *EventChain {
+	t.Helper()
+	keys := &TrustStore{}
+	keys.AddIdentity(identity.ID, identity.PublicKey(), true)
+	chain := &EventChain{Difficulty: 1, Keys: keys}
+	if dir != "" {
+		store, err := OpenEventStore(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { store.Close() })
+		chain.Store = store
+		if err := chain.Load(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return chain
+}
+
+// mineAfter mines an event extending prev, or starting a chain if prev is
+// nil, without adding it.
+func mineAfter(chain *EventChain, identity *Identity, prev *Event, data string) *Event {
+	event := identity.SignEvent("", data)
+	event.PrevHash = genesisHash
+	if prev != nil {
+		event.Height = prev.Height + 1
+		event.PrevHash = prev.Hash
+	}
+	chain.Mine(event)
+	return event
+}
+
+func TestChainReorg(t *testing.T) {
+	identity, _ := NewIdentity()
+	chain := testChain(t, identity, "")
+	reorgs := chain.SubscribeReorgs()
+	for i := 0; i < 3; i++ {
+		if err := chain.Append(identity.SignEvent("", fmt.Sprint("main ", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	base := chain.At(0)
+	fork := base
+	for i := 0; i < 3; i++ {
+		fork = mineAfter(chain, identity, fork, fmt.Sprint("fork ", i))
+		if err := chain.Add(fork); err != nil {
+			t.Fatal(err)
+		}
+		if i < 2 && chain.Last().Hash == fork.Hash {
+			t.Fatalf("switched to a fork of %d events that isn't heavier", i+1)
+		}
+	}
+	if chain.Last().Hash != fork.Hash || chain.Len() != 4 {
+		t.Fatalf("chain did not switch to the heavier fork")
+	}
+	if chain.At(1).Data != "fork 0" {
+		t.Fatalf("height 1 holds %q", chain.At(1).Data)
+	}
+	select {
+	case reorg := <-reorgs:
+		if reorg.Ancestor != base || len(reorg.Removed) != 2 || len(reorg.Added) != 3 {
+			t.Fatalf("reorg from %v removed %d and added %d", reorg.Ancestor, len(reorg.Removed), len(reorg.Added))
+		}
+	default:
+		t.Fatal("no reorg notified")
+	}
+	if err := chain.Add(fork); err != ErrDuplicate {
+		t.Fatalf("adding an event twice gave %v", err)
+	}
+}
+
+func TestEventStoreReload(t *testing.T) {
+	dir := t.TempDir()
+	identity, _ := NewIdentity()
+	chain := testChain(t, identity, dir)
+	for i := 0; i < 4; i++ {
+		if err := chain.Append(identity.SignEvent("", fmt.Sprint("main ", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fork := chain.At(1)
+	for i := 0; i < 3; i++ {
+		fork = mineAfter(chain, identity, fork, fmt.Sprint("fork ", i))
+		if err := chain.Add(fork); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := chain.Range(0, 10)
+	if len(want) != 5 || want[4].Hash != fork.Hash {
+		t.Fatalf("chain has %d events before reload", len(want))
+	}
+	chain.Store.Close()
+
+	check := func(reloaded *EventChain) {
+		t.Helper()
+		if reloaded.Len() != len(want) || reloaded.Last().Hash != fork.Hash {
+			t.Fatalf("reloaded chain has %d events ending in %v", reloaded.Len(), reloaded.Last())
+		}
+		got := reloaded.Range(0, 10)
+		for i := range want {
+			if got[i].Hash != want[i].Hash || reloaded.At(i).Hash != want[i].Hash {
+				t.Fatalf("height %d holds %s, want %s", i, got[i].Hash, want[i].Hash)
+			}
+		}
+		if len(reloaded.Hashes()) != 7 {
+			t.Fatalf("reloaded store knows %d events, want 7", len(reloaded.Hashes()))
+		}
+		if reloaded.Get(reloaded.Store.Hashes()[0]) == nil {
+			t.Fatal("stored event not found")
+		}
+		next := mineAfter(reloaded, identity, reloaded.Last(), "after reload")
+		if err := reloaded.Add(next); err != nil {
+			t.Fatalf("extending the reloaded head: %v", err)
+		}
+		reloaded.Store.Close()
+	}
+	check(testChain(t, identity, dir))
+
+	// A store from before the heights file existed gets it rebuilt.
+	if err := os.Remove(filepath.Join(dir, "heights")); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := testChain(t, identity, dir)
+	if reloaded.Len() != 6 {
+		t.Fatalf("rebuilt heights hold %d events, want 6", reloaded.Len())
+	}
+}
+
+func TestTrustFollowsCanonicalChain(t *testing.T) {
+	for _, dir := range []string{"", t.TempDir()} {
+		identity, _ := NewIdentity()
+		other, _ := NewIdentity()
+		chain := testChain(t, identity, dir)
+		if err := chain.Append(identity.SignEvent("", "genesis")); err != nil {
+			t.Fatal(err)
+		}
+		base := chain.At(0)
+		update, _ := json.Marshal(TrustUpdate{Op: "add", Key: other.PublicKey()})
+		if err := chain.Append(identity.SignEvent("trust", string(update))); err != nil {
+			t.Fatal(err)
+		}
+		if chain.Keys.Lookup(other.ID) == nil {
+			t.Fatal("trust event on the canonical chain not applied")
+		}
+
+		fork := base
+		for i := 0; i < 2; i++ {
+			fork = mineAfter(chain, identity, fork, fmt.Sprint("fork ", i))
+			if err := chain.Add(fork); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if chain.Last().Hash != fork.Hash {
+			t.Fatal("chain did not switch to the heavier fork")
+		}
+		if chain.Keys.Lookup(other.ID) != nil {
+			t.Fatal("key added on the abandoned branch still trusted")
+		}
+		if chain.Keys.Lookup(identity.ID) == nil {
+			t.Fatal("configured key lost on reorg")
+		}
+
+		if err := chain.Append(identity.SignEvent("trust", string(update))); err != nil {
+			t.Fatal(err)
+		}
+		if dir != "" {
+			chain.Store.Close()
+			reloaded := testChain(t, identity, dir)
+			if reloaded.Keys.Lookup(other.ID) == nil {
+				t.Fatal("trust event on the canonical chain not applied after reload")
+			}
+		}
+	}
+}
+
+func TestForkVerifiedAgainstItsOwnKeys(t *testing.T) {
+	for _, dir := range []string{"", t.TempDir()} {
+		identity, _ := NewIdentity()
+		chain := testChain(t, identity, dir)
+		for i := 0; i < 3; i++ {
+			if err := chain.Append(identity.SignEvent("", fmt.Sprint("main ", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		next, rotation, err := identity.Rotate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rotation.PrevHash = chain.At(0).Hash
+		rotation.Height = 1
+		chain.Mine(rotation)
+		if err := chain.Add(rotation); err != nil {
+			t.Fatal(err)
+		}
+		fork := rotation
+		for i := 0; i < 3; i++ {
+			fork = mineAfter(chain, next, fork, fmt.Sprint("fork ", i))
+			if err := chain.Add(fork); err != nil {
+				t.Fatalf("event signed with the key rotated on the fork: %v", err)
+			}
+		}
+		if chain.Last().Hash != fork.Hash {
+			t.Fatal("chain did not switch to the heavier fork")
+		}
+		if author := chain.Keys.Lookup(identity.ID); author == nil || !author.Key.Equal(next.PublicKey()) {
+			t.Fatal("rotation on the adopted fork not applied")
+		}
+
+		stale := mineAfter(chain, identity, chain.At(3), "old key")
+		if err := chain.Add(stale); err == nil {
+			t.Fatal("event signed with the rotated key accepted")
+		}
+		other := mineAfter(chain, identity, chain.At(2), "old branch")
+		if err := chain.Validate(other); err == nil {
+			t.Fatal("key rotated before the branch point accepted on a side branch")
+		}
+		if dir != "" {
+			chain.Store.Close()
+		}
+	}
+}
+
+func TestRangeCopiesTopic(t *testing.T) {
+	identity, _ := NewIdentity()
+	chain := testChain(t, identity, "")
+	event := identity.SignEvent("", "hello")
+	event.Topic = "news"
+	identity.Sign(event)
+	if err := chain.Append(event); err != nil {
+		t.Fatal(err)
+	}
+	events := chain.Range(0, 0)
+	if len(events) != 1 || events[0].Topic != "news" {
+		t.Fatalf("range returned %+v", events)
+	}
+	if err := (&EventChain{Difficulty: 1, Keys: chain.Keys}).verify(events[0], nil); err != nil {
+		t.Fatalf("copied event does not verify: %v", err)
+	}
+}
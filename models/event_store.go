@@ -0,0 +1,497 @@
+package models
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"kademlia/constants"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type eventLocation struct {
+	Segment int
+	Offset  int64
+	Length  int
+	Height  int
+	Trust   bool
+}
+
+// heightRecord is the size of an entry of the heights file: a hash and a
+// newline, so the entry for a height sits at a fixed offset.
+const heightRecord = 41
+
+// EventStore persists events in append-only segment files under Dir, one
+// JSON record per line, with an index file mapping every event hash to its
+// position so single events can be read back without scanning, and a
+// heights file listing the hashes of the canonical chain by height. Each
+// write is synced before the one that refers to it: a record before its
+// index entry, an index entry before the heights that name it.
+type EventStore struct {
+	Dir      string
+	mu       sync.Mutex
+	segments []int
+	segment  *os.File
+	readers  map[int]*os.File
+	size     int64
+	indexLog *os.File
+	index    map[string]eventLocation
+	heights  *os.File
+	length   int
+}
+
+func OpenEventStore(dir string) (*EventStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	es := &EventStore{Dir: dir, index: make(map[string]eventLocation), readers: make(map[int]*os.File)}
+	names, err := filepath.Glob(filepath.Join(dir, "segment-*.log"))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		var id int
+		if _, err := fmt.Sscanf(filepath.Base(name), "segment-%06d.log", &id); err == nil {
+			es.segments = append(es.segments, id)
+		}
+	}
+	sort.Ints(es.segments)
+	if len(es.segments) > 0 {
+		if err := es.trimTorn(es.segments[len(es.segments)-1]); err != nil {
+			return nil, err
+		}
+	}
+	if err := es.loadIndex(); err != nil {
+		return nil, err
+	}
+	if len(es.segments) == 0 {
+		es.segments = []int{1}
+	}
+	if err := es.openSegment(es.segments[len(es.segments)-1]); err != nil {
+		return nil, err
+	}
+	es.indexLog, err = os.OpenFile(filepath.Join(dir, "index"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := es.openHeights(); err != nil {
+		return nil, err
+	}
+	return es, nil
+}
+
+func (es *EventStore) segmentPath(id int) string {
+	return filepath.Join(es.Dir, fmt.Sprintf("segment-%06d.log", id))
+}
+
+func (es *EventStore) openSegment(id int) error {
+	file, err := os.OpenFile(es.segmentPath(id), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if es.segment != nil {
+		es.readers[es.segments[len(es.segments)-1]] = es.segment
+	}
+	es.segment = file
+	es.size = info.Size()
+	if es.segments[len(es.segments)-1] != id {
+		es.segments = append(es.segments, id)
+	}
+	return nil
+}
+
+// trimTorn cuts a partially written record off the end of a segment so
+// that later appends start on a fresh line.
+func (es *EventStore) trimTorn(id int) error {
+	file, err := os.OpenFile(es.segmentPath(id), os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	tail := int64(1 << 16)
+	if tail > size {
+		tail = size
+	}
+	buf := make([]byte, tail)
+	if _, err := file.ReadAt(buf, size-tail); err != nil {
+		return err
+	}
+	end := bytes.LastIndexByte(buf, '\n')
+	if end == len(buf)-1 {
+		return nil
+	}
+	return file.Truncate(size - tail + int64(end) + 1)
+}
+
+// loadIndex reads the index file, dropping entries that point past the end
+// of their segment. If the index is missing or does not cover the segments
+// it is rebuilt from them.
+func (es *EventStore) loadIndex() error {
+	sizes := make(map[int]int64)
+	for _, id := range es.segments {
+		info, err := os.Stat(es.segmentPath(id))
+		if err != nil {
+			return err
+		}
+		sizes[id] = info.Size()
+	}
+
+	covered := make(map[int]int64)
+	file, err := os.Open(filepath.Join(es.Dir, "index"))
+	if err == nil {
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var hash string
+			var location eventLocation
+			_, err := fmt.Sscanf(scanner.Text(), "%s %d %d %d %d %t", &hash, &location.Segment, &location.Offset, &location.Length, &location.Height, &location.Trust)
+			if err != nil || location.Offset+int64(location.Length) > sizes[location.Segment] {
+				continue
+			}
+			es.index[hash] = location
+			if end := location.Offset + int64(location.Length); end > covered[location.Segment] {
+				covered[location.Segment] = end
+			}
+		}
+		file.Close()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	for _, id := range es.segments {
+		if covered[id] < sizes[id] {
+			return es.rebuildIndex()
+		}
+	}
+	return nil
+}
+
+func (es *EventStore) rebuildIndex() error {
+	es.index = make(map[string]eventLocation)
+	var lines []string
+	err := es.scan(func(event *Event, location eventLocation) error {
+		es.index[event.Hash] = location
+		lines = append(lines, indexLine(event.Hash, location))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(es.Dir, "index"), []byte(strings.Join(lines, "")), 0600)
+}
+
+// scan reads every complete record of every segment in the order it was
+// written. A torn record at the end of a segment is ignored.
+func (es *EventStore) scan(fn func(event *Event, location eventLocation) error) error {
+	for _, id := range es.segments {
+		file, err := os.Open(es.segmentPath(id))
+		if err != nil {
+			return err
+		}
+		reader := bufio.NewReaderSize(file, 1<<20)
+		var offset int64
+		for {
+			line, err := reader.ReadBytes('\n')
+			if err != nil {
+				break
+			}
+			location := eventLocation{Segment: id, Offset: offset, Length: len(line)}
+			offset += int64(len(line))
+			var event Event
+			if json.Unmarshal(line, &event) != nil {
+				continue
+			}
+			location.Height = event.Height
+			location.Trust = event.Kind == "trust"
+			if err := fn(&event, location); err != nil {
+				file.Close()
+				return err
+			}
+		}
+		file.Close()
+	}
+	return nil
+}
+
+func (es *EventStore) Append(event *Event) error {
+	record, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	record = append(record, '\n')
+
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	if _, ok := es.index[event.Hash]; ok {
+		return nil
+	}
+	if es.size+int64(len(record)) > constants.SEGMENT_SIZE && es.size > 0 {
+		if err := es.openSegment(es.segments[len(es.segments)-1] + 1); err != nil {
+			return err
+		}
+	}
+	location := eventLocation{Segment: es.segments[len(es.segments)-1], Offset: es.size, Length: len(record), Height: event.Height, Trust: event.Kind == "trust"}
+	if _, err := es.segment.WriteAt(record, es.size); err != nil {
+		return err
+	}
+	if err := es.segment.Sync(); err != nil {
+		return err
+	}
+	es.size += int64(len(record))
+	if _, err := io.WriteString(es.indexLog, indexLine(event.Hash, location)); err != nil {
+		return err
+	}
+	if err := es.indexLog.Sync(); err != nil {
+		return err
+	}
+	es.index[event.Hash] = location
+	return nil
+}
+
+func indexLine(hash string, location eventLocation) string {
+	return fmt.Sprintf("%s %d %d %d %d %t\n", hash, location.Segment, location.Offset, location.Length, location.Height, location.Trust)
+}
+
+// openHeights opens the heights file, cutting off a torn entry and any
+// entries for events the segments lost. A store written before the file
+// existed gets it from its longest chain.
+func (es *EventStore) openHeights() error {
+	path := filepath.Join(es.Dir, "heights")
+	_, statErr := os.Stat(path)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	es.heights = file
+	if os.IsNotExist(statErr) && len(es.index) > 0 {
+		return es.rebuildHeights()
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	es.length = int(info.Size() / heightRecord)
+	for es.length > 0 {
+		hash, err := es.canonicalHash(es.length - 1)
+		if err != nil {
+			return err
+		}
+		if _, ok := es.index[hash]; ok {
+			break
+		}
+		es.length -= 1
+	}
+	return file.Truncate(int64(es.length) * heightRecord)
+}
+
+// rebuildHeights follows the highest stored event back to the first one.
+func (es *EventStore) rebuildHeights() error {
+	tip, best := "", eventLocation{Height: -1}
+	for hash, location := range es.index {
+		if location.Height > best.Height || (location.Height == best.Height && hash < tip) {
+			tip, best = hash, location
+		}
+	}
+	hashes := make([]string, best.Height+1)
+	for hash := tip; hash != "" && hash != genesisHash; {
+		event, err := es.get(hash)
+		if err != nil {
+			return err
+		}
+		if event.Height < 0 || event.Height >= len(hashes) {
+			return fmt.Errorf("event %s: %w", hash, ErrBadLink)
+		}
+		hashes[event.Height] = hash
+		hash = event.PrevHash
+	}
+	return es.setCanonical(0, hashes)
+}
+
+func (es *EventStore) canonicalHash(height int) (string, error) {
+	record := make([]byte, heightRecord)
+	if _, err := es.heights.ReadAt(record, int64(height)*heightRecord); err != nil {
+		return "", err
+	}
+	return string(bytes.TrimSpace(record)), nil
+}
+
+// CanonicalHash returns the hash of the canonical event at height, or ""
+// if the chain is shorter.
+func (es *EventStore) CanonicalHash(height int) string {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	if height < 0 || height >= es.length {
+		return ""
+	}
+	hash, err := es.canonicalHash(height)
+	if err != nil {
+		return ""
+	}
+	return hash
+}
+
+func (es *EventStore) setCanonical(from int, hashes []string) error {
+	var records bytes.Buffer
+	for _, hash := range hashes {
+		if len(hash) != heightRecord-1 {
+			return fmt.Errorf("%w: hash %q", ErrMalformed, hash)
+		}
+		records.WriteString(hash + "\n")
+	}
+	if _, err := es.heights.WriteAt(records.Bytes(), int64(from)*heightRecord); err != nil {
+		return err
+	}
+	es.length = from + len(hashes)
+	if err := es.heights.Truncate(int64(es.length) * heightRecord); err != nil {
+		return err
+	}
+	return es.heights.Sync()
+}
+
+// Canonical returns the hashes of the canonical chain by height.
+func (es *EventStore) Canonical() []string {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	records := make([]byte, es.length*heightRecord)
+	if _, err := es.heights.ReadAt(records, 0); err != nil && err != io.EOF {
+		return nil
+	}
+	hashes := make([]string, es.length)
+	for i := range hashes {
+		hashes[i] = string(records[i*heightRecord : (i+1)*heightRecord-1])
+	}
+	return hashes
+}
+
+// SetCanonical makes hashes the canonical events from height from on,
+// dropping the ones above them.
+func (es *EventStore) SetCanonical(from int, hashes []string) error {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	if from < 0 || from > es.length {
+		return fmt.Errorf("canonical chain has no height %d", from-1)
+	}
+	return es.setCanonical(from, hashes)
+}
+
+// Len is the length of the canonical chain.
+func (es *EventStore) Len() int {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	return es.length
+}
+
+// At reads the canonical event at height.
+func (es *EventStore) At(height int) (*Event, error) {
+	hash := es.CanonicalHash(height)
+	if hash == "" {
+		return nil, ErrNotFound
+	}
+	return es.Get(hash)
+}
+
+// Hashes returns the sorted hashes of every stored event.
+func (es *EventStore) Hashes() []string {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	hashes := make([]string, 0, len(es.index))
+	for hash := range es.index {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	return hashes
+}
+
+// TrustHashes returns the hashes of every stored trust event, ordered by
+// height.
+func (es *EventStore) TrustHashes() []string {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	var hashes []string
+	for hash, location := range es.index {
+		if location.Trust {
+			hashes = append(hashes, hash)
+		}
+	}
+	sort.Slice(hashes, func(i, j int) bool {
+		return es.index[hashes[i]].Height < es.index[hashes[j]].Height
+	})
+	return hashes
+}
+
+func (es *EventStore) Get(hash string) (*Event, error) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	return es.get(hash)
+}
+
+func (es *EventStore) get(hash string) (*Event, error) {
+	location, ok := es.index[hash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	file, err := es.reader(location.Segment)
+	if err != nil {
+		return nil, err
+	}
+	record := make([]byte, location.Length)
+	if _, err := file.ReadAt(record, location.Offset); err != nil {
+		return nil, err
+	}
+	var event Event
+	if err := json.Unmarshal(record, &event); err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
+
+// reader returns the open file of segment id, opening it the first time.
+func (es *EventStore) reader(id int) (*os.File, error) {
+	if id == es.segments[len(es.segments)-1] {
+		return es.segment, nil
+	}
+	if file, ok := es.readers[id]; ok {
+		return file, nil
+	}
+	file, err := os.Open(es.segmentPath(id))
+	if err != nil {
+		return nil, err
+	}
+	es.readers[id] = file
+	return file, nil
+}
+
+// Each calls fn for every stored event in the order they were appended,
+// which always puts an event after the one it extends.
+func (es *EventStore) Each(fn func(event *Event) error) error {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	return es.scan(func(event *Event, location eventLocation) error {
+		return fn(event)
+	})
+}
+
+func (es *EventStore) Close() error {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	for _, file := range es.readers {
+		file.Close()
+	}
+	es.indexLog.Close()
+	es.heights.Close()
+	return es.segment.Close()
+}
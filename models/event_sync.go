@@ -0,0 +1,192 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"kademlia/constants"
+	"net"
+	"time"
+)
+
+type ChainHead struct {
+	Hash   string `json:"hash"`
+	Height int    `json:"height"`
+	Work   uint64 `json:"work"`
+}
+
+type EventRange struct {
+	From int `json:"from"`
+	To   int `json:"to"`
+}
+
+func (p *Peer) ChainHead() (ChainHead, error) {
+	var head ChainHead
+	msgType, data, _, err := p.SendRecv("chain head", []byte(""))
+	if err != nil {
+		return head, err
+	}
+	if msgType != "head" {
+		return head, unexpected(msgType)
+	}
+	err = decode(data, &head)
+	return head, err
+}
+
+func (p *Peer) GetEvents(from int, to int) ([]*Event, error) {
+	data, err := json.Marshal(EventRange{From: from, To: to})
+	if err != nil {
+		return nil, err
+	}
+	msgType, reply, _, err := p.SendRecv("get events", data)
+	if err != nil {
+		return nil, err
+	}
+	if msgType != "events" {
+		return nil, unexpected(msgType)
+	}
+	var events []*Event
+	err = decode(reply, &events)
+	return events, err
+}
+
+func (s *Server) handleChainHead(addr *net.UDPAddr, key []byte) {
+	head := ChainHead{Height: -1}
+	if last := s.Events.Last(); last != nil {
+		head = ChainHead{Hash: last.Hash, Height: last.Height, Work: last.Work}
+	}
+	msg, err := json.Marshal(head)
+	if err != nil {
+		return
+	}
+	s.Send(addr, key, "head", msg)
+}
+
+// handleGetEvents answers with as many events of the requested range as fit
+// in a single datagram, but always at least one.
+func (s *Server) handleGetEvents(addr *net.UDPAddr, key []byte, data []byte) {
+	var request EventRange
+	if err := decode(data, &request); err != nil {
+		s.fault(addr, err)
+		return
+	}
+	if request.To-request.From >= constants.SYNC_BATCH {
+		request.To = request.From + constants.SYNC_BATCH - 1
+	}
+	events := s.Events.Range(request.From, request.To)
+	msg, err := json.Marshal(events)
+	for err == nil && len(events) > 1 && len(msg) > constants.MAX_VALUE_SIZE {
+		events = events[:len(events)-1]
+		msg, err = json.Marshal(events)
+	}
+	if err != nil {
+		return
+	}
+	s.Send(addr, key, "events", msg)
+}
+
+// SyncEvents compares chains with peer and, if the peer's chain carries more
+// work, downloads the events after the last common ancestor and adds them,
+// letting the chain reorganize onto the heavier branch.
+func (s *Server) SyncEvents(peer *Peer) error {
+	head, err := peer.ChainHead()
+	if err != nil {
+		return err
+	}
+	last := s.Events.Last()
+	if head.Height < 0 || (last != nil && head.Work <= last.Work) || s.Events.Get(head.Hash) != nil {
+		return nil
+	}
+
+	top := head.Height
+	if last == nil {
+		top = -1
+	} else if last.Height < top {
+		top = last.Height
+	}
+	ancestor, err := s.commonAncestor(peer, top)
+	if err != nil {
+		return err
+	}
+
+	for from := ancestor + 1; from <= head.Height; {
+		events, err := peer.GetEvents(from, head.Height)
+		if err != nil {
+			return err
+		}
+		if len(events) == 0 {
+			return errors.New("peer returned no events")
+		}
+		for _, event := range events {
+			if event.Height != from {
+				return errors.New("peer returned events out of order")
+			}
+			err := s.Events.Add(event)
+			if err == nil {
+				s.emit(event)
+			} else if !errors.Is(err, ErrDuplicate) {
+				return err
+			}
+			from += 1
+		}
+	}
+	return nil
+}
+
+// commonAncestor returns the height of the last event of peer's chain this
+// node also has, at or below top, or -1 if they share none. Steps back from
+// top double in size until one lands on a known event, then a binary search
+// narrows down the gap, so a fork deep in the chain takes a logarithmic
+// number of requests.
+func (s *Server) commonAncestor(peer *Peer, top int) (int, error) {
+	known := func(height int) (bool, error) {
+		events, err := peer.GetEvents(height, height)
+		if err != nil {
+			return false, err
+		}
+		return len(events) == 1 && s.Events.Get(events[0].Hash) != nil, nil
+	}
+	low, high := -1, top+1
+	for step := 1; top >= 0; step *= 2 {
+		ok, err := known(top)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			low = top
+			break
+		}
+		high = top
+		top -= step
+	}
+	for high-low > 1 {
+		middle := (low + high) / 2
+		ok, err := known(middle)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			low = middle
+		} else {
+			high = middle
+		}
+	}
+	return low, nil
+}
+
+func (s *Server) syncLoop() {
+	for {
+		time.Sleep(constants.SYNC_INTERVAL * time.Second)
+		if s.Table.Empty() {
+			continue
+		}
+		peers := Shuffle(s.Table.ListPeers())
+		if len(peers) > s.A {
+			peers = peers[:s.A]
+		}
+		for _, peer := range peers {
+			if err := s.SyncEvents(peer); err != nil {
+				s.logger("sync").Debug("sync failed", "peer", peer.ID, "err", err)
+			}
+		}
+	}
+}
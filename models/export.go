@@ -0,0 +1,192 @@
+package models
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// TableExport is a snapshot of the routing table. Each bucket covers the
+// IDs from its Min to its Max peer.
+type TableExport struct {
+	ID      string       `json:"id"`
+	K       int          `json:"k"`
+	Buckets []BucketInfo `json:"buckets"`
+}
+
+// ChainNode is an event of an exported chain. Events on forks the chain
+// doesn't follow are not Canonical.
+type ChainNode struct {
+	Hash      string `json:"hash"`
+	PrevHash  string `json:"prev_hash"`
+	Height    int    `json:"height"`
+	Author    string `json:"author"`
+	Kind      string `json:"kind,omitempty"`
+	Topic     string `json:"topic,omitempty"`
+	Canonical bool   `json:"canonical"`
+}
+
+func bucketInfo(bucket *KBucket) BucketInfo {
+	info := BucketInfo{K: bucket.K, Peers: peerInfos(bucket.InOrder())}
+	if bucket.Root != nil {
+		info.Root = bucket.Root.ID
+		info.Min = bucket.Min().ID
+		info.Max = bucket.Max().ID
+	}
+	return info
+}
+
+// BucketInfos describes every bucket of the table.
+func (rt *RoutingTable) BucketInfos() []BucketInfo {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	buckets := []BucketInfo{}
+	for _, bucket := range rt.List() {
+		buckets = append(buckets, bucketInfo(bucket))
+	}
+	return buckets
+}
+
+func (s *Server) ExportTable() TableExport {
+	return TableExport{ID: s.ID, K: s.Table.K, Buckets: s.Table.BucketInfos()}
+}
+
+// Tree returns every known event, forks included, ordered by height. With
+// a Store that means reading all of it, which is done after letting go of
+// the chain so events can still be added meanwhile.
+func (ec *EventChain) Tree() []ChainNode {
+	ec.mu.Lock()
+	var events []*Event
+	var hashes []string
+	canonical := make(map[string]bool)
+	if ec.Store != nil {
+		hashes = ec.Store.Hashes()
+		for _, hash := range ec.Store.Canonical() {
+			canonical[hash] = true
+		}
+	} else {
+		for _, event := range ec.events {
+			events = append(events, event)
+		}
+		for _, event := range ec.canonical {
+			canonical[event.Hash] = true
+		}
+	}
+	ec.mu.Unlock()
+
+	for _, hash := range hashes {
+		event, err := ec.Store.Get(hash)
+		if err != nil {
+			return []ChainNode{}
+		}
+		events = append(events, event)
+	}
+	nodes := []ChainNode{}
+	for _, event := range events {
+		nodes = append(nodes, ChainNode{
+			Hash:      event.Hash,
+			PrevHash:  event.PrevHash,
+			Height:    event.Height,
+			Author:    event.Author,
+			Kind:      event.Kind,
+			Topic:     event.Topic,
+			Canonical: canonical[event.Hash],
+		})
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].Height != nodes[j].Height {
+			return nodes[i].Height < nodes[j].Height
+		}
+		return nodes[i].Hash < nodes[j].Hash
+	})
+	return nodes
+}
+
+func short(id string) string {
+	if len(id) > 8 {
+		return id[:8]
+	}
+	return id
+}
+
+// WriteTableDOT renders the routing table as a Graphviz graph with a
+// cluster per bucket.
+func WriteTableDOT(w io.Writer, table TableExport) {
+	fmt.Fprintf(w, "digraph table {\n\tnode [shape=box, fontname=monospace];\n")
+	fmt.Fprintf(w, "\t%q [label=%q, style=bold];\n", table.ID, "self\n"+short(table.ID))
+	for i, bucket := range table.Buckets {
+		label := fmt.Sprintf("bucket %d (%d/%d)\n%s .. %s", i, len(bucket.Peers), bucket.K, short(bucket.Min), short(bucket.Max))
+		fmt.Fprintf(w, "\tsubgraph cluster_%d {\n\t\tlabel=%q;\n", i, label)
+		for _, peer := range bucket.Peers {
+			seen := "never seen"
+			if !peer.LastSeen.IsZero() {
+				seen = "seen " + time.Since(peer.LastSeen).Round(time.Second).String() + " ago"
+			}
+			label := short(peer.ID) + "\n" + peer.Addr + "\nrtt " + peer.RTT.String() + ", " + seen
+			fmt.Fprintf(w, "\t\t%q [label=%q];\n", peer.ID, label)
+		}
+		fmt.Fprintf(w, "\t}\n")
+		for _, peer := range bucket.Peers {
+			fmt.Fprintf(w, "\t%q -> %q;\n", table.ID, peer.ID)
+		}
+	}
+	fmt.Fprintf(w, "}\n")
+}
+
+// WriteChainDOT renders the event tree, drawing forks the chain doesn't
+// follow dashed.
+func WriteChainDOT(w io.Writer, nodes []ChainNode) {
+	fmt.Fprintf(w, "digraph chain {\n\trankdir=LR;\n\tnode [shape=box, fontname=monospace];\n")
+	for _, node := range nodes {
+		label := strconv.Itoa(node.Height) + "\n" + short(node.Hash) + "\nby " + short(node.Author)
+		if node.Kind != "" {
+			label += "\n" + node.Kind
+		}
+		if node.Topic != "" {
+			label += "\n#" + node.Topic
+		}
+		style := ""
+		if !node.Canonical {
+			style = ", style=dashed, color=gray"
+		}
+		fmt.Fprintf(w, "\t%q [label=%q%s];\n", node.Hash, label, style)
+	}
+	for _, node := range nodes {
+		if node.Height > 0 {
+			fmt.Fprintf(w, "\t%q -> %q;\n", node.PrevHash, node.Hash)
+		}
+	}
+	fmt.Fprintf(w, "}\n")
+}
+
+// WriteTopologyDOT renders a crawl as a graph of which nodes know which.
+// Nodes that didn't answer are gray, and contacts the crawl didn't reach
+// are left out.
+func WriteTopologyDOT(w io.Writer, topology *Topology) {
+	fmt.Fprintf(w, "digraph topology {\n\tnode [shape=ellipse, fontname=monospace];\n")
+	var ids []string
+	for id := range topology.Nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		node := topology.Nodes[id]
+		style := ""
+		if id == topology.Root {
+			style = ", style=bold"
+		} else if !node.Responsive {
+			style = ", color=gray, fontcolor=gray"
+		}
+		fmt.Fprintf(w, "\t%q [label=%q%s];\n", id, short(id)+"\n"+node.Addr, style)
+	}
+	for _, id := range ids {
+		for _, neighbor := range topology.Nodes[id].Neighbors {
+			if _, ok := topology.Nodes[neighbor]; ok {
+				fmt.Fprintf(w, "\t%q -> %q;\n", id, neighbor)
+			}
+		}
+	}
+	fmt.Fprintf(w, "}\n")
+}
@@ -0,0 +1,285 @@
+package models
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"kademlia/constants"
+	"net"
+	"sync"
+	"time"
+)
+
+type GossipMessage struct {
+	ID    string     `json:"id"`
+	Hops  int        `json:"hops"`
+	Event MsgRequest `json:"event"`
+}
+
+type cachedMessage struct {
+	message GossipMessage
+	at      time.Time
+}
+
+// Gossip disseminates events epidemically. Each message is pushed to Fanout
+// random peers and forwarded at most TTL hops; message IDs are remembered for
+// SeenTTL so every node processes a message once. Recent messages are also
+// advertised lazily with IHAVE so peers that missed a push can ask for them
+// with IWANT.
+type Gossip struct {
+	Fanout  int
+	TTL     int
+	SeenTTL time.Duration
+	mu      sync.Mutex
+	seen    map[string]time.Time
+	cache   map[string]*cachedMessage
+}
+
+// MessageID identifies an event on the wire. Chain events already have a
+// unique mined hash; topic events are identified by their signature.
+func MessageID(event *Event) string {
+	if event.Hash != "" {
+		return event.Hash
+	}
+	hash := sha1.New()
+	hash.Write(event.Signature)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func (g *Gossip) fanout() int {
+	if g.Fanout > 0 {
+		return g.Fanout
+	}
+	return constants.GOSSIP_FANOUT
+}
+
+func (g *Gossip) ttl() int {
+	if g.TTL > 0 {
+		return g.TTL
+	}
+	return constants.GOSSIP_TTL
+}
+
+func (g *Gossip) seenTTL() time.Duration {
+	if g.SeenTTL > 0 {
+		return g.SeenTTL
+	}
+	return constants.GOSSIP_SEEN_TTL * time.Second
+}
+
+// timely reports whether a topic event published at is recent enough to
+// still be in the seen-cache of every node that processed it, half the seen
+// TTL either way, so replays of older ones can be told apart.
+func (g *Gossip) timely(at int64) bool {
+	window := g.seenTTL() / 2
+	published := time.Unix(at, 0)
+	return time.Since(published) <= window && time.Until(published) <= window
+}
+
+func (g *Gossip) expire() {
+	now := time.Now()
+	for id, at := range g.seen {
+		if now.Sub(at) > g.seenTTL() {
+			delete(g.seen, id)
+		}
+	}
+	for id, cached := range g.cache {
+		if now.Sub(cached.at) > g.seenTTL() {
+			delete(g.cache, id)
+		}
+	}
+}
+
+func (g *Gossip) Seen(id string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	at, ok := g.seen[id]
+	return ok && time.Since(at) <= g.seenTTL()
+}
+
+// MarkSeen records id and reports whether it had not been seen before.
+func (g *Gossip) MarkSeen(id string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.seen == nil {
+		g.seen = make(map[string]time.Time)
+	}
+	g.expire()
+	if _, ok := g.seen[id]; ok {
+		return false
+	}
+	g.seen[id] = time.Now()
+	return true
+}
+
+func (g *Gossip) remember(message GossipMessage) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.cache == nil {
+		g.cache = make(map[string]*cachedMessage)
+	}
+	g.cache[message.ID] = &cachedMessage{message: message, at: time.Now()}
+}
+
+func (g *Gossip) recent() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var ids []string
+	for id, cached := range g.cache {
+		if time.Since(cached.at) <= constants.GOSSIP_WINDOW*constants.HEARTBEAT*time.Second {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) > constants.GOSSIP_IHAVE_MAX {
+		ids = ids[:constants.GOSSIP_IHAVE_MAX]
+	}
+	return ids
+}
+
+func (g *Gossip) cached(id string) (GossipMessage, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	cached, ok := g.cache[id]
+	if !ok {
+		return GossipMessage{}, false
+	}
+	return cached.message, true
+}
+
+func (p *Peer) Gossip(message GossipMessage) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	_, _, _, err = p.SendRecv("message", data)
+	return err
+}
+
+func (p *Peer) IHave(ids []string) ([]string, error) {
+	data, err := json.Marshal(ids)
+	if err != nil {
+		return nil, err
+	}
+	msgType, reply, _, err := p.SendRecv("ihave", data)
+	if err != nil {
+		return nil, err
+	}
+	if msgType != "iwant" {
+		return nil, unexpected(msgType)
+	}
+	var wanted []string
+	err = decode(reply, &wanted)
+	return wanted, err
+}
+
+func (s *Server) randomPeers(n int, exclude string) []*Peer {
+	if s.Table.Empty() {
+		return nil
+	}
+	var peers []*Peer
+	for _, peer := range Shuffle(s.Table.ListPeers()) {
+		if len(peers) == n {
+			break
+		}
+		if peer.ID != exclude {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+func (s *Server) forward(message GossipMessage, exclude string) {
+	if message.Hops >= s.Gossip.ttl() {
+		return
+	}
+	for _, peer := range s.randomPeers(s.Gossip.fanout(), exclude) {
+		go peer.Gossip(message)
+	}
+}
+
+func (s *Server) Broadcast(event *Event) {
+	message := GossipMessage{ID: MessageID(event), Event: event.AsMsgRequest()}
+	s.Gossip.MarkSeen(message.ID)
+	s.Gossip.remember(message)
+	s.forward(message, "")
+}
+
+func (s *Server) handleMessage(addr *net.UDPAddr, key []byte, data []byte) {
+	s.Send(addr, key, "received", []byte(""))
+	var message GossipMessage
+	if err := decode(data, &message); err != nil {
+		s.fault(addr, err)
+		return
+	}
+	peerID := NodeID(addr.IP)
+	event := message.Event.AsEvent()
+	message.ID = MessageID(event)
+	if s.Gossip.Seen(message.ID) {
+		return
+	}
+	err := s.Events.Add(event)
+	if err == nil || errors.Is(err, ErrDuplicate) {
+		if !s.Gossip.MarkSeen(message.ID) {
+			return
+		}
+	}
+	if err == nil {
+		s.logger("gossip").Debug("accepted message", "peer", peerID, "id", message.ID, "hops", message.Hops)
+		s.emit(event)
+		s.Gossip.remember(message)
+		message.Hops += 1
+		s.forward(message, peerID)
+	} else if errors.Is(err, ErrBadSignature) || errors.Is(err, ErrUnknownAuthor) {
+		s.logger("gossip").Warn("message is not authentic", "peer", peerID, "id", message.ID, "err", err)
+	} else if errors.Is(err, ErrUnknownPrev) {
+		s.logger("gossip").Debug("message extends unknown event, syncing", "peer", peerID, "id", message.ID)
+		if sender := s.Table.FindPeer(peerID); sender != nil {
+			go s.SyncEvents(sender)
+		}
+	}
+}
+
+func (s *Server) handleIHave(addr *net.UDPAddr, key []byte, data []byte) {
+	var ids []string
+	if err := decode(data, &ids); err != nil {
+		s.fault(addr, err)
+		return
+	}
+	wanted := []string{}
+	for _, id := range ids {
+		if !s.Gossip.Seen(id) && s.Events.Get(id) == nil {
+			wanted = append(wanted, id)
+		}
+	}
+	msg, err := json.Marshal(wanted)
+	if err != nil {
+		return
+	}
+	s.Send(addr, key, "iwant", msg)
+}
+
+// gossipLoop advertises recently seen messages to random peers every
+// heartbeat and pushes whichever of them they ask for.
+func (s *Server) gossipLoop() {
+	for {
+		time.Sleep(constants.HEARTBEAT * time.Second)
+		ids := s.Gossip.recent()
+		if len(ids) == 0 {
+			continue
+		}
+		for _, peer := range s.randomPeers(s.Gossip.fanout(), "") {
+			go func(peer *Peer) {
+				wanted, err := peer.IHave(ids)
+				if err != nil {
+					return
+				}
+				for _, id := range wanted {
+					if message, ok := s.Gossip.cached(id); ok {
+						peer.Gossip(message)
+					}
+				}
+			}(peer)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package models
+
+import (
+	"fmt"
+	"kademlia/constants"
+	"testing"
+	"time"
+)
+
+func TestGossipSeenExpires(t *testing.T) {
+	g := Gossip{SeenTTL: 50 * time.Millisecond}
+	if !g.MarkSeen("a") || g.MarkSeen("a") || !g.Seen("a") {
+		t.Fatal("message not remembered as seen")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if g.Seen("a") {
+		t.Fatal("message still seen after SeenTTL")
+	}
+	if !g.MarkSeen("a") {
+		t.Fatal("expired message not accepted again")
+	}
+}
+
+func TestGossipRecent(t *testing.T) {
+	var g Gossip
+	for i := 0; i < constants.GOSSIP_IHAVE_MAX+5; i++ {
+		g.remember(GossipMessage{ID: fmt.Sprint(i)})
+	}
+	if ids := g.recent(); len(ids) != constants.GOSSIP_IHAVE_MAX {
+		t.Fatalf("advertised %d messages", len(ids))
+	}
+	for _, cached := range g.cache {
+		cached.at = time.Now().Add(-constants.GOSSIP_WINDOW*constants.HEARTBEAT*time.Second - time.Second)
+	}
+	if ids := g.recent(); len(ids) != 0 {
+		t.Fatalf("advertised %d messages older than the window", len(ids))
+	}
+}
+
+// TestGossipHops checks that a message is forwarded until it has travelled
+// TTL hops and no further.
+func TestGossipHops(t *testing.T) {
+	identity, _ := NewIdentity()
+	a := newTestServer("127.0.0.1")
+	b := startTestServer(t, "127.0.0.2")
+	a.Gossip.TTL = 2
+	b.Events.Keys = &TrustStore{}
+	b.Events.Keys.AddIdentity(identity.ID, identity.PublicKey(), false)
+	a.Table.AddPeer(testPeer(b))
+
+	exhausted := mineAfter(&a.Events, identity, nil, "exhausted")
+	live := mineAfter(&a.Events, identity, nil, "live")
+	a.forward(GossipMessage{ID: exhausted.Hash, Hops: 2, Event: exhausted.AsMsgRequest()}, "")
+	a.forward(GossipMessage{ID: live.Hash, Hops: 1, Event: live.AsMsgRequest()}, "")
+	for deadline := time.Now().Add(10 * time.Second); b.Events.Get(live.Hash) == nil; {
+		if time.Now().After(deadline) {
+			t.Fatal("message within its TTL not forwarded")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if b.Events.Get(exhausted.Hash) != nil {
+		t.Fatal("message forwarded past its TTL")
+	}
+}
+
+// TestIHaveIWant checks that a peer only asks for advertised messages it
+// has neither seen nor stored.
+func TestIHaveIWant(t *testing.T) {
+	identity, _ := NewIdentity()
+	b := startTestServer(t, "127.0.0.2")
+	b.Events.Keys = &TrustStore{}
+	b.Events.Keys.AddIdentity(identity.ID, identity.PublicKey(), false)
+	stored := identity.SignEvent("", "stored")
+	if err := b.Events.Append(stored); err != nil {
+		t.Fatal(err)
+	}
+	b.Gossip.MarkSeen("seen")
+
+	wanted, err := testPeer(b).IHave([]string{stored.Hash, "seen", "missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(wanted) != 1 || wanted[0] != "missing" {
+		t.Fatalf("asked for %v", wanted)
+	}
+}
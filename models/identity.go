@@ -0,0 +1,176 @@
+package models
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"kademlia/constants"
+	"kademlia/utils"
+	"os"
+)
+
+var ErrPassphrase = errors.New("wrong passphrase")
+
+// Identity is the key a node signs events with and the author ID they are
+// published under. The ID is the ID of the first key and is kept across
+// rotations, so trust granted to it survives a key change.
+type Identity struct {
+	ID  string
+	Key ed25519.PrivateKey
+}
+
+func NewIdentity() (*Identity, error) {
+	_, privKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{ID: KeyID(privKey.Public().(ed25519.PublicKey)), Key: privKey}, nil
+}
+
+func (id *Identity) PublicKey() ed25519.PublicKey {
+	return id.Key.Public().(ed25519.PublicKey)
+}
+
+func (id *Identity) Sign(event *Event) {
+	event.Author = id.ID
+	event.Signature = ed25519.Sign(id.Key, event.SignedData())
+}
+
+func (id *Identity) SignEvent(kind string, data string) *Event {
+	event := &Event{Data: data, Kind: kind}
+	id.Sign(event)
+	return event
+}
+
+// MailKey derives the X25519 key mail for this node is sealed to from the
+// identity key, so it survives restarts and changes on rotation.
+func (id *Identity) MailKey() (*ecdh.PrivateKey, error) {
+	seed := sha256.Sum256(append([]byte("mail\x00"), id.Key.Seed()...))
+	return ecdh.X25519().NewPrivateKey(seed[:])
+}
+
+// SignMailKey signs the mail key of the node with ID node.
+func (id *Identity) SignMailKey(node string) (*MailKey, error) {
+	key, err := id.MailKey()
+	if err != nil {
+		return nil, err
+	}
+	signed := &MailKey{Node: node, Key: key.PublicKey().Bytes(), Author: id.ID, PubKey: id.PublicKey()}
+	signed.Signature = ed25519.Sign(id.Key, signed.signedData())
+	return signed, nil
+}
+
+func rotationProof(id string, key ed25519.PublicKey) []byte {
+	return []byte("rotate\x00" + id + "\x00" + hex.EncodeToString(key))
+}
+
+// Rotate generates the next key of the identity and the "trust" event,
+// signed with the current key, that tells peers to accept the new one.
+func (id *Identity) Rotate() (*Identity, *Event, error) {
+	next, err := NewIdentity()
+	if err != nil {
+		return nil, nil, err
+	}
+	next.ID = id.ID
+	update := TrustUpdate{
+		Op:    "rotate",
+		ID:    id.ID,
+		Key:   next.PublicKey(),
+		Proof: ed25519.Sign(next.Key, rotationProof(id.ID, next.PublicKey())),
+	}
+	data, err := json.Marshal(update)
+	if err != nil {
+		return nil, nil, err
+	}
+	return next, id.SignEvent("trust", string(data)), nil
+}
+
+// Save writes the identity as a PKCS#8 PEM file readable only by the
+// current user. With a passphrase the key is written as an "ENCRYPTED
+// PRIVATE KEY" block, encrypted with PBES2.
+func (id *Identity) Save(path string, passphrase []byte) error {
+	der, err := x509.MarshalPKCS8PrivateKey(id.Key)
+	if err != nil {
+		return err
+	}
+	block := &pem.Block{Type: "PRIVATE KEY", Headers: map[string]string{}, Bytes: der}
+	if id.ID != KeyID(id.PublicKey()) {
+		block.Headers["Identity"] = id.ID
+	}
+	if len(passphrase) > 0 {
+		block.Type = "ENCRYPTED PRIVATE KEY"
+		block.Bytes, err = utils.EncryptPKCS8(der, passphrase, constants.KEY_ITERATIONS)
+		if err != nil {
+			return err
+		}
+	}
+	return ioutil.WriteFile(path, pem.EncodeToMemory(block), 0600)
+}
+
+// LoadIdentity reads an identity written by Save. Files holding the raw 64
+// byte key written by earlier versions are still accepted.
+func LoadIdentity(path string, passphrase []byte) (*Identity, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		if len(data) != ed25519.PrivateKeySize {
+			return nil, fmt.Errorf("%s: not a PEM encoded private key", path)
+		}
+		key := ed25519.PrivateKey(data)
+		return &Identity{ID: KeyID(key.Public().(ed25519.PublicKey)), Key: key}, nil
+	}
+	der := block.Bytes
+	if block.Type == "ENCRYPTED PRIVATE KEY" {
+		if len(passphrase) == 0 {
+			return nil, fmt.Errorf("%s is encrypted and needs a passphrase", path)
+		}
+		var err error
+		der, err = utils.DecryptPKCS8(der, passphrase)
+		if errors.Is(err, utils.ErrDecrypt) {
+			return nil, fmt.Errorf("%s: %w", path, ErrPassphrase)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	} else if block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("%s: unexpected PEM block %q", path, block.Type)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an ed25519 key", path)
+	}
+	identity := &Identity{ID: KeyID(key.Public().(ed25519.PublicKey)), Key: key}
+	if id := block.Headers["Identity"]; id != "" {
+		identity.ID = id
+	}
+	return identity, nil
+}
+
+// LoadOrCreateIdentity loads the identity at path, generating and saving a
+// new one if the file doesn't exist yet.
+func LoadOrCreateIdentity(path string, passphrase []byte) (*Identity, bool, error) {
+	identity, err := LoadIdentity(path, passphrase)
+	if !os.IsNotExist(err) {
+		return identity, false, err
+	}
+	identity, err = NewIdentity()
+	if err != nil {
+		return nil, false, err
+	}
+	return identity, true, identity.Save(path, passphrase)
+}
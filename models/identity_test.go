@@ -0,0 +1,40 @@
+package models
+
+import (
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIdentityEncrypted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "priv_key.pem")
+	identity, _ := NewIdentity()
+	next, _, err := identity.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := next.Save(path, []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(path)
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "ENCRYPTED PRIVATE KEY" {
+		t.Fatalf("saved %q block", block.Type)
+	}
+
+	if _, err := LoadIdentity(path, []byte("wrong")); !errors.Is(err, ErrPassphrase) {
+		t.Fatalf("wrong passphrase gave %v", err)
+	}
+	if _, err := LoadIdentity(path, nil); err == nil {
+		t.Fatal("loaded an encrypted key without a passphrase")
+	}
+	loaded, err := LoadIdentity(path, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.ID != identity.ID || !loaded.Key.Equal(next.Key) {
+		t.Fatal("loaded a different identity")
+	}
+}
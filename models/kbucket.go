@@ -4,7 +4,6 @@ import (
 	"crypto/sha1"
 	"encoding/binary"
 	"encoding/hex"
-	"fmt"
 	"io"
 	"kademlia/utils"
 	"math"
@@ -45,10 +44,14 @@ func (kb *KBucket) add(new_peer *Peer, current *Peer) {
 }
 
 func (kb *KBucket) Delete(id string) *Peer {
-	return kb.delete(id, kb.Root)
+	kb.Root = kb.delete(id, kb.Root)
+	return kb.Root
 }
 
 func (kb *KBucket) delete(id string, current *Peer) *Peer {
+	if current == nil {
+		return nil
+	}
 	targetByteID, _ := hex.DecodeString(id)
 	targetIntID := binary.BigEndian.Uint64(targetByteID)
 	currentByteID, _ := hex.DecodeString(current.ID)
@@ -58,15 +61,19 @@ func (kb *KBucket) delete(id string, current *Peer) *Peer {
 	} else if targetIntID > currentIntID {
 		current.Right = kb.delete(id, current.Right)
 	} else {
+		var replacement *Peer
 		if current.Left == nil {
-			return current.Right
+			replacement = current.Right
 		} else if current.Right == nil {
-			return current.Left
+			replacement = current.Left
 		} else {
-			temp := kb.min(current.Right)
-			current.ID = temp.ID
-			current.Right = kb.delete(temp.ID, current.Right)
+			replacement = kb.min(current.Right)
+			replacement.Right = kb.delete(replacement.ID, current.Right)
+			replacement.Left = current.Left
 		}
+		current.Left = nil
+		current.Right = nil
+		return replacement
 	}
 	return current
 }
@@ -98,21 +105,21 @@ func (kb *KBucket) findNode(id string, current *Peer) *Peer {
 	}
 }
 
-func (kb *KBucket) FindClosest(id string) Peer {
-	var closest Peer
+func (kb *KBucket) FindClosest(id string) *Peer {
+	var closest *Peer
 	distance := math.Inf(1)
 	kb.findClosest(id, &closest, &distance, kb.Root)
 	return closest
 }
 
-func (kb *KBucket) findClosest(id string, closest *Peer, distance *float64, current *Peer) {
+func (kb *KBucket) findClosest(id string, closest **Peer, distance *float64, current *Peer) {
 	targetByteID, _ := hex.DecodeString(id)
 	targetIntID := binary.BigEndian.Uint64(targetByteID)
 	currentByteID, _ := hex.DecodeString(current.ID)
 	currentIntID := binary.BigEndian.Uint64(currentByteID)
 	if *distance > float64(targetIntID^currentIntID) {
 		*distance = float64(targetIntID ^ currentIntID)
-		*closest = *current
+		*closest = current
 	}
 
 	if current.Left != nil {
@@ -277,20 +284,7 @@ func (kb *KBucket) MerkleRoot() string {
 	for _, peer := range kb.InOrder() {
 		leaves = append(leaves, peer.ID)
 	}
-	for len(leaves) > 1 {
-		if len(leaves)&1 == 1 {
-			leaves = append(leaves, leaves[len(leaves)-1])
-		}
-		var newLeaves []string
-		for i := 0; i < len(leaves); i += 2 {
-			h := sha1.New()
-			io.WriteString(h, leaves[i]+leaves[i+1])
-			leaf := fmt.Sprintf("%x", h.Sum(nil))
-			newLeaves = append(newLeaves, leaf)
-		}
-		leaves = newLeaves
-	}
-	return leaves[0]
+	return utils.MerkleRoot(leaves)
 }
 
 func (kb *KBucket) CalculateNonce() int {
@@ -4,9 +4,16 @@ import (
 	"math/big"
 )
 
+// KeyOffer opens a handshake, or answers one. Answers carry the difficulty
+// the server currently requires from the client, and an offer whose proof
+// of work falls short is answered with Type "difficulty" and no Key. The
+// proof of work covers the offered Key and Time, the Unix time it was mined
+// at, so it can't be reused for other keys or long after.
 type KeyOffer struct {
-	Type  string   `json:"type"`
-	Nonce int      `json:"nonce"`
-	Prime *big.Int `json:"prime"`
-	Key   *big.Int `json:"key"`
+	Type       string   `json:"type"`
+	Nonce      int      `json:"nonce"`
+	Time       int64    `json:"time,omitempty"`
+	Prime      *big.Int `json:"prime"`
+	Key        *big.Int `json:"key"`
+	Difficulty int      `json:"difficulty,omitempty"`
 }
@@ -0,0 +1,40 @@
+package models
+
+import (
+	"io"
+	"log/slog"
+)
+
+var quiet = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// NewLogger returns a logger writing records at or above level to w, as
+// JSON lines if json is set and as key=value text otherwise.
+func NewLogger(w io.Writer, level slog.Level, json bool) *slog.Logger {
+	options := &slog.HandlerOptions{Level: level}
+	if json {
+		return slog.New(slog.NewJSONHandler(w, options))
+	}
+	return slog.New(slog.NewTextHandler(w, options))
+}
+
+// logger returns the server's logger tagged with subsystem. A server
+// without one, such as a node embedded in another application, is quiet.
+func (s *Server) logger(subsystem string) *slog.Logger {
+	if s.Log == nil {
+		return quiet
+	}
+	return s.Log.With("subsystem", subsystem)
+}
+
+func (s *Server) logReorgs() {
+	for reorg := range s.Events.SubscribeReorgs() {
+		ancestor := genesisHash
+		if reorg.Ancestor != nil {
+			ancestor = reorg.Ancestor.Hash
+		}
+		s.logger("chain").Info("reorganized chain",
+			"ancestor", ancestor,
+			"removed", len(reorg.Removed),
+			"added", len(reorg.Added))
+	}
+}
@@ -0,0 +1,111 @@
+package models
+
+import (
+	"sync"
+)
+
+// lookup runs an iterative Kademlia lookup towards id, asking up to A peers
+// at a time. query is called for every contacted peer and returns the closer
+// contacts it learned about; returning stop ends the lookup after the
+// current round.
+func (s *Server) lookup(id string, query func(peer *Peer) ([]Tuple, bool, error)) []*Peer {
+	var mu sync.Mutex
+	shortlist := s.Table.FindKClosest(id, s.Table.K)
+	seen := map[string]bool{s.ID: true}
+	for _, peer := range shortlist {
+		seen[peer.ID] = true
+	}
+	queried := map[string]bool{}
+	failed := map[string]bool{}
+	stop := false
+	hops := 0
+
+	for !stop {
+		var round []*Peer
+		for _, peer := range shortlist {
+			if !queried[peer.ID] {
+				round = append(round, peer)
+				if len(round) == s.A {
+					break
+				}
+			}
+		}
+		if len(round) == 0 {
+			break
+		}
+		hops += 1
+
+		var wg sync.WaitGroup
+		for _, peer := range round {
+			queried[peer.ID] = true
+			wg.Add(1)
+			go func(peer *Peer) {
+				defer wg.Done()
+				tuples, done, err := query(peer)
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					failed[peer.ID] = true
+					return
+				}
+				if done {
+					stop = true
+				}
+				for _, tuple := range tuples {
+					if tuple.Addr == nil {
+						continue
+					}
+					contact := s.Table.FindPeer(NodeID(tuple.Addr.IP))
+					if contact == nil {
+						contact = tuple.AsPeer()
+					}
+					if !seen[contact.ID] {
+						seen[contact.ID] = true
+						shortlist = append(shortlist, contact)
+					}
+				}
+			}(peer)
+		}
+		wg.Wait()
+
+		var alive []*Peer
+		for _, peer := range shortlist {
+			if !failed[peer.ID] {
+				alive = append(alive, peer)
+			}
+		}
+		SortByDistance(alive, id)
+		if len(alive) > s.Table.K {
+			alive = alive[:s.Table.K]
+		}
+		shortlist = alive
+	}
+
+	DefaultMetrics.Observe("kademlia_lookup_hops", "", float64(hops))
+
+	var closest []*Peer
+	for _, peer := range shortlist {
+		if queried[peer.ID] && !failed[peer.ID] {
+			closest = append(closest, peer)
+		}
+	}
+	if len(closest) > 0 {
+		s.Size.add(estimateSize(id, closest))
+	}
+	return closest
+}
+
+func (s *Server) Lookup(id string) []*Peer {
+	return s.lookup(id, func(peer *Peer) ([]Tuple, bool, error) {
+		msgType, data, _, err := peer.FindNode(id)
+		if err != nil {
+			return nil, false, err
+		}
+		if msgType != "found" {
+			return nil, false, unexpected(msgType)
+		}
+		var neighbors []Tuple
+		err = decode(data, &neighbors)
+		return neighbors, false, err
+	})
+}
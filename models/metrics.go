@@ -0,0 +1,225 @@
+package models
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	hopBuckets      = []float64{1, 2, 3, 4, 5, 6, 8, 10, 15, 20}
+	miningBuckets   = []float64{.01, .05, .1, .5, 1, 5, 10, 30, 60, 300}
+)
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+type metric struct {
+	kind    string
+	help    string
+	buckets []float64
+	values  map[string]float64
+	hists   map[string]*histogram
+}
+
+// Metrics is a small registry of counters and histograms rendered in the
+// Prometheus text format. Series are identified by a metric name and a
+// rendered label set such as `type="ping"`.
+type Metrics struct {
+	mu      sync.Mutex
+	metrics map[string]*metric
+}
+
+// DefaultMetrics collects what every peer and server in the process does.
+var DefaultMetrics = NewMetrics()
+
+func NewMetrics() *Metrics {
+	m := &Metrics{metrics: make(map[string]*metric)}
+	m.counter("kademlia_requests_total", "Requests served, by message type.")
+	m.counter("kademlia_rpc_errors_total", "Requests to peers that failed, by message type.")
+	m.histogram("kademlia_rpc_duration_seconds", "Round trip time of requests to peers, including the handshake, by message type.", durationBuckets)
+	m.histogram("kademlia_handshake_duration_seconds", "Time taken by key exchanges with peers.", durationBuckets)
+	m.histogram("kademlia_lookup_hops", "Rounds of queries an iterative lookup needed.", hopBuckets)
+	m.histogram("kademlia_pow_mining_seconds", "Time taken to mine an event.", miningBuckets)
+	return m
+}
+
+func (m *Metrics) counter(name string, help string) {
+	m.metrics[name] = &metric{kind: "counter", help: help, values: make(map[string]float64)}
+}
+
+func (m *Metrics) histogram(name string, help string, buckets []float64) {
+	m.metrics[name] = &metric{kind: "histogram", help: help, buckets: buckets, hists: make(map[string]*histogram)}
+}
+
+func (m *Metrics) Inc(name string, labels string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if metric, ok := m.metrics[name]; ok && metric.kind == "counter" {
+		metric.values[labels] += 1
+	}
+}
+
+func (m *Metrics) Observe(name string, labels string, value float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	metric, ok := m.metrics[name]
+	if !ok || metric.kind != "histogram" {
+		return
+	}
+	h, ok := metric.hists[labels]
+	if !ok {
+		h = &histogram{buckets: metric.buckets, counts: make([]uint64, len(metric.buckets))}
+		metric.hists[labels] = h
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[i] += 1
+		}
+	}
+	h.sum += value
+	h.count += 1
+}
+
+func (m *Metrics) Since(name string, labels string, start time.Time) {
+	m.Observe(name, labels, time.Since(start).Seconds())
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func Label(name string, value string) string {
+	return name + `="` + labelEscaper.Replace(value) + `"`
+}
+
+func series(name string, labels string, extra string) string {
+	if labels != "" && extra != "" {
+		labels += "," + extra
+	} else if extra != "" {
+		labels = extra
+	}
+	if labels == "" {
+		return name
+	}
+	return name + "{" + labels + "}"
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func sortedLabels(values map[string]float64) []string {
+	var labels []string
+	for label := range values {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+func (m *Metrics) Render(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var names []string
+	for name := range m.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		metric := m.metrics[name]
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, metric.help, name, metric.kind)
+		for _, labels := range sortedLabels(metric.values) {
+			fmt.Fprintf(w, "%s %s\n", series(name, labels, ""), formatFloat(metric.values[labels]))
+		}
+		var hists []string
+		for labels := range metric.hists {
+			hists = append(hists, labels)
+		}
+		sort.Strings(hists)
+		for _, labels := range hists {
+			h := metric.hists[labels]
+			for i, bound := range h.buckets {
+				fmt.Fprintf(w, "%s %d\n", series(name+"_bucket", labels, Label("le", formatFloat(bound))), h.counts[i])
+			}
+			fmt.Fprintf(w, "%s %d\n", series(name+"_bucket", labels, `le="+Inf"`), h.count)
+			fmt.Fprintf(w, "%s %s\n", series(name+"_sum", labels, ""), formatFloat(h.sum))
+			fmt.Fprintf(w, "%s %d\n", series(name+"_count", labels, ""), h.count)
+		}
+	}
+}
+
+func writeGauge(w io.Writer, name string, help string, values map[string]float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	for _, labels := range sortedLabels(values) {
+		fmt.Fprintf(w, "%s %s\n", series(name, labels, ""), formatFloat(values[labels]))
+	}
+}
+
+// requestTypes are the message types handle answers. Others are counted as
+// "other" so metrics aren't labelled with whatever type a sender makes up.
+var requestTypes = map[string]bool{
+	"find node": true, "ping": true, "message": true, "ihave": true,
+	"store": true, "find value": true, "add provider": true, "get providers": true,
+	"store record": true, "find record": true, "chain head": true, "get events": true,
+	"merkle children": true, "merkle leaves": true, "get event": true,
+	"direct": true, "deposit": true, "collect": true, "collected": true, "mail key": true,
+	"graft": true, "prune": true, "publish": true, "blacklist": true,
+}
+
+func requestType(msgType string) string {
+	if requestTypes[msgType] {
+		return msgType
+	}
+	return "other"
+}
+
+// writeState renders gauges read from the server at scrape time.
+func (s *Server) writeState(w io.Writer) {
+	buckets := make(map[string]float64)
+	peers := 0
+	for i, bucket := range s.Table.BucketInfos() {
+		size := len(bucket.Peers)
+		buckets[Label("bucket", strconv.Itoa(i))] = float64(size)
+		peers += size
+	}
+	writeGauge(w, "kademlia_routing_bucket_peers", "Peers in each bucket of the routing table.", buckets)
+	writeGauge(w, "kademlia_routing_peers", "Peers in the routing table.", map[string]float64{"": float64(peers)})
+	writeGauge(w, "kademlia_network_size_estimate", "Estimated number of nodes in the network.", map[string]float64{"": s.NetworkSize().Estimate})
+	writeGauge(w, "kademlia_admission_difficulty", "Proof of work difficulty required from new peers.", map[string]float64{"": float64(s.Admission.Required("", s.Difficulty))})
+	writeGauge(w, "kademlia_chain_height", "Events on the canonical chain.", map[string]float64{"": float64(s.Events.Len())})
+	drops := make(map[string]float64)
+	for reason, count := range s.Drops.Counts() {
+		drops[Label("reason", reason)] = float64(count)
+	}
+	fmt.Fprintf(w, "# HELP kademlia_dropped_requests_total Requests dropped as invalid, by reason.\n# TYPE kademlia_dropped_requests_total counter\n")
+	for _, labels := range sortedLabels(drops) {
+		fmt.Fprintf(w, "%s %s\n", series("kademlia_dropped_requests_total", labels, ""), formatFloat(drops[labels]))
+	}
+}
+
+// MetricsHandler serves the process metrics and this server's state in the
+// Prometheus text format.
+func (s *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		DefaultMetrics.Render(w)
+		s.writeState(w)
+	})
+}
+
+// ServeMetrics exposes /metrics on addr until the listener fails.
+func (s *Server) ServeMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", s.MetricsHandler())
+	s.logger("metrics").Info("serving metrics", "addr", addr)
+	return http.ListenAndServe(addr, mux)
+}
@@ -0,0 +1,40 @@
+package models
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestMetricsState(t *testing.T) {
+	s := newTestServer("127.0.0.1")
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for _, peer := range testPeers(50) {
+			s.Table.AddPeer(peer)
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		s.writeState(&bytes.Buffer{})
+	}
+	wg.Wait()
+	var out bytes.Buffer
+	s.writeState(&out)
+	if !strings.Contains(out.String(), "kademlia_routing_peers 50\n") {
+		t.Fatalf("state:\n%s", out.String())
+	}
+}
+
+func TestUnknownRequestType(t *testing.T) {
+	s := newTestServer("127.0.0.1")
+	s.handle(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 4444}, nil, Msg{Type: "made up"})
+	var out bytes.Buffer
+	DefaultMetrics.Render(&out)
+	if strings.Contains(out.String(), "made up") || !strings.Contains(out.String(), `type="other"`) {
+		t.Fatalf("metrics:\n%s", out.String())
+	}
+}
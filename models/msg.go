@@ -1,6 +1,67 @@
 package models
 
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kademlia/constants"
+	"net"
+	"strings"
+)
+
+// Msg is a request or reply. Crawl marks requests from a crawler, whose
+// sender is not added to the routing table.
 type Msg struct {
-	Type string `json:"type"`
-	Data []byte `json:"data"`
+	Type  string `json:"type"`
+	Data  []byte `json:"data"`
+	Crawl bool   `json:"crawl,omitempty"`
+}
+
+// readMessage reads datagrams from conn until the end of transmission byte
+// and returns the message without it. A datagram from another sender
+// starts the message over.
+func readMessage(conn *net.UDPConn) (string, *net.UDPAddr, error) {
+	var msg strings.Builder
+	var from *net.UDPAddr
+	for {
+		chunk := make([]byte, constants.BUFFER)
+		n, addr, err := conn.ReadFromUDP(chunk)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return "", addr, ErrTimeout
+			}
+			return "", addr, err
+		}
+		if from != nil && !sameAddr(addr, from) {
+			msg.Reset()
+		}
+		from = addr
+		msg.Write(chunk[:n])
+		if end := strings.IndexByte(msg.String(), 4); end >= 0 {
+			return strings.TrimSpace(msg.String()[:end]), addr, nil
+		}
+		if msg.Len() > constants.MAX_MESSAGE {
+			return "", addr, fmt.Errorf("%w: message exceeds %d bytes", ErrMalformed, constants.MAX_MESSAGE)
+		}
+	}
+}
+
+func sameAddr(a *net.UDPAddr, b *net.UDPAddr) bool {
+	return a != nil && b != nil && a.IP.Equal(b.IP) && a.Port == b.Port
+}
+
+func decode(data []byte, v interface{}) error {
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	return nil
+}
+
+func unexpected(msgType string) error {
+	return fmt.Errorf("%w %q", ErrUnexpectedReply, msgType)
+}
+
+func rejected(reply []byte) error {
+	return fmt.Errorf("%w: %s", ErrRejected, reply)
 }
@@ -2,5 +2,43 @@ package models
 
 type MsgRequest struct {
 	Msg       string `json:"msg"`
+	Kind      string `json:"kind,omitempty"`
+	Topic     string `json:"topic,omitempty"`
+	Time      int64  `json:"time,omitempty"`
+	Author    string `json:"author"`
 	Signature []byte `json:"signature"`
+	PrevHash  string `json:"prev_hash"`
+	Height    int    `json:"height"`
+	Nonce     int    `json:"nonce"`
+	Hash      string `json:"hash"`
+}
+
+func (e *Event) AsMsgRequest() MsgRequest {
+	return MsgRequest{
+		Msg:       e.Data,
+		Kind:      e.Kind,
+		Topic:     e.Topic,
+		Time:      e.Time,
+		Author:    e.Author,
+		Signature: e.Signature,
+		PrevHash:  e.PrevHash,
+		Height:    e.Height,
+		Nonce:     e.Nonce,
+		Hash:      e.Hash,
+	}
+}
+
+func (r MsgRequest) AsEvent() *Event {
+	return &Event{
+		Data:      r.Msg,
+		Kind:      r.Kind,
+		Topic:     r.Topic,
+		Time:      r.Time,
+		Author:    r.Author,
+		Signature: r.Signature,
+		PrevHash:  r.PrevHash,
+		Height:    r.Height,
+		Nonce:     r.Nonce,
+		Hash:      r.Hash,
+	}
 }
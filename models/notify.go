@@ -0,0 +1,177 @@
+package models
+
+import (
+	"kademlia/constants"
+	"net"
+	"sync"
+	"time"
+)
+
+type DHTEventType string
+
+const (
+	DHTFindNode     DHTEventType = "find node"
+	DHTStore        DHTEventType = "store"
+	DHTFindValue    DHTEventType = "find value"
+	DHTAddProvider  DHTEventType = "add provider"
+	DHTGetProviders DHTEventType = "get providers"
+	DHTStoreRecord  DHTEventType = "store record"
+	DHTFindRecord   DHTEventType = "find record"
+)
+
+// DHTEvent describes a DHT request this node served: what was asked, for
+// which key, and by which node.
+type DHTEvent struct {
+	Type DHTEventType `json:"type"`
+	Key  string       `json:"key"`
+	Peer string       `json:"peer"`
+	At   time.Time    `json:"at"`
+}
+
+// EventFilter selects the events a subscriber receives. Empty fields match
+// anything.
+type EventFilter struct {
+	Kind   string
+	Topic  string
+	Author string
+}
+
+func (f EventFilter) Match(event *Event) bool {
+	return (f.Kind == "" || f.Kind == event.Kind) &&
+		(f.Topic == "" || f.Topic == event.Topic) &&
+		(f.Author == "" || f.Author == event.Author)
+}
+
+type subscription struct {
+	filter EventFilter
+	events chan Event
+}
+
+// Notifier fans out what the node observes to embedding applications. As
+// with reorg notifications, a subscriber that falls behind misses events
+// rather than stalling the node.
+type Notifier struct {
+	mu          sync.Mutex
+	events      []*subscription
+	dht         []chan DHTEvent
+	onPeerJoin  []func(*Peer)
+	onPeerLeave []func(*Peer)
+}
+
+// Subscribe returns a channel receiving every event matching filter that
+// reaches this node: chain events, topic events and direct messages (which
+// have Kind "direct" and the sender's node ID as Author).
+func (s *Server) Subscribe(filter EventFilter) <-chan Event {
+	s.Notify.mu.Lock()
+	defer s.Notify.mu.Unlock()
+	events := make(chan Event, constants.SUBSCRIBER_BUFFER)
+	s.Notify.events = append(s.Notify.events, &subscription{filter: filter, events: events})
+	return events
+}
+
+func (s *Server) Unsubscribe(events <-chan Event) {
+	s.Notify.mu.Lock()
+	defer s.Notify.mu.Unlock()
+	for i, sub := range s.Notify.events {
+		if sub.events == events {
+			close(sub.events)
+			s.Notify.events = append(s.Notify.events[:i], s.Notify.events[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *Server) SubscribeDHT() <-chan DHTEvent {
+	s.Notify.mu.Lock()
+	defer s.Notify.mu.Unlock()
+	events := make(chan DHTEvent, constants.SUBSCRIBER_BUFFER)
+	s.Notify.dht = append(s.Notify.dht, events)
+	return events
+}
+
+func (s *Server) OnPeerJoin(callback func(*Peer)) {
+	s.Notify.mu.Lock()
+	defer s.Notify.mu.Unlock()
+	s.Notify.onPeerJoin = append(s.Notify.onPeerJoin, callback)
+}
+
+func (s *Server) OnPeerLeave(callback func(*Peer)) {
+	s.Notify.mu.Lock()
+	defer s.Notify.mu.Unlock()
+	s.Notify.onPeerLeave = append(s.Notify.onPeerLeave, callback)
+}
+
+func (s *Server) emit(event *Event) {
+	s.Notify.mu.Lock()
+	defer s.Notify.mu.Unlock()
+	for _, sub := range s.Notify.events {
+		if !sub.filter.Match(event) {
+			continue
+		}
+		copied := *event
+		copied.Prev = nil
+		select {
+		case sub.events <- copied:
+		default:
+		}
+	}
+}
+
+func (s *Server) emitDHT(eventType DHTEventType, key string, addr *net.UDPAddr) {
+	s.Notify.mu.Lock()
+	defer s.Notify.mu.Unlock()
+	if len(s.Notify.dht) == 0 {
+		return
+	}
+	event := DHTEvent{Type: eventType, Key: key, Peer: NodeID(addr.IP), At: time.Now()}
+	for _, events := range s.Notify.dht {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
+
+func (s *Server) peerJoined(peer *Peer) {
+	s.logger("routing").Info("peer joined", "peer", peer.ID, "addr", peer.Addr.String())
+	s.Notify.mu.Lock()
+	callbacks := append([]func(*Peer){}, s.Notify.onPeerJoin...)
+	s.Notify.mu.Unlock()
+	for _, callback := range callbacks {
+		callback(peer)
+	}
+}
+
+func (s *Server) peerLeft(peer *Peer) {
+	lastSeen, _ := peer.Stats()
+	s.logger("routing").Info("peer left", "peer", peer.ID, "last_seen", lastSeen)
+	s.Topics.removePeer(peer.ID)
+	s.Notify.mu.Lock()
+	callbacks := append([]func(*Peer){}, s.Notify.onPeerLeave...)
+	s.Notify.mu.Unlock()
+	for _, callback := range callbacks {
+		callback(peer)
+	}
+}
+
+func (s *Server) livenessLoop() {
+	for {
+		time.Sleep(constants.LIVENESS_INTERVAL * time.Second)
+		s.checkLiveness()
+	}
+}
+
+// checkLiveness pings every known peer and removes the ones that left
+// LIVENESS_FAILURES requests in a row unanswered from the routing table.
+func (s *Server) checkLiveness() {
+	for _, peer := range s.Table.ListPeers() {
+		if peer.Ping() {
+			_, rtt := peer.Stats()
+			s.logger("routing").Debug("ping", "peer", peer.ID, "rtt", rtt)
+		} else if peer.Failures() >= constants.LIVENESS_FAILURES {
+			if removed := s.Table.RemovePeer(peer.ID); removed != nil {
+				s.peerLeft(removed)
+			}
+		}
+	}
+}
@@ -7,67 +7,124 @@ import (
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
-	"errors"
+	"fmt"
 	"io"
 	"kademlia/constants"
 	"kademlia/utils"
 	"math/big"
 	"net"
 	"strconv"
-	"strings"
+	"sync"
 	"time"
 )
 
 type Peer struct {
-	ID         string       `json:"id"`
-	Addr       *net.UDPAddr `json:"address"`
-	Left       *Peer        `json:"left"`
-	Right      *Peer        `json:"right"`
-	Difficulty int          `json:"difficulty"`
-	AesKey     []byte       `json:"aes_key"`
-	Generator  *big.Int     `json:"generator"`
-	PrivKey    *big.Int     `json:"priv_key"`
-	PubKey     *big.Int     `json:"pub_key"`
-	Prime      *big.Int     `json:"prime"`
-	JoinedAt   time.Time    `json:"joined_at"`
-	LastLookup time.Time    `json:"last_looup"`
+	ID         string        `json:"id"`
+	Addr       *net.UDPAddr  `json:"address"`
+	Left       *Peer         `json:"left"`
+	Right      *Peer         `json:"right"`
+	Difficulty int           `json:"difficulty"`
+	Generator  *big.Int      `json:"generator"`
+	JoinedAt   time.Time     `json:"joined_at"`
+	LastLookup time.Time     `json:"last_looup"`
+	LastSeen   time.Time     `json:"last_seen"`
+	RTT        time.Duration `json:"rtt"`
+	crawler    bool
+	failures   int
+	pow        *proof
+	mu         sync.Mutex
 }
 
-func (p *Peer) generatePrime() {
-	if p.Prime == nil {
-		v, e := rand.Prime(rand.Reader, 2048)
-		utils.CheckError(e)
-		p.Prime = v
-	}
+var (
+	primeOnce sync.Once
+	prime     *big.Int
+	primeErr  error
+)
+
+// sharedPrime is the DH modulus offered to every peer. Generating a 2048-bit
+// prime takes long, so it is done once per process.
+func sharedPrime() (*big.Int, error) {
+	primeOnce.Do(func() {
+		prime, primeErr = rand.Prime(rand.Reader, 2048)
+	})
+	return prime, primeErr
 }
 
-func (p *Peer) generatePrivateKey() {
-	priv_key := make([]byte, constants.KEY_LENGTH)
-	_, err := rand.Read(priv_key)
-	utils.CheckError(err)
-	p.PrivKey = new(big.Int).SetBytes(priv_key)
+// session is the key exchange state of a single request, so requests to the
+// same peer can run concurrently.
+type session struct {
+	prime   *big.Int
+	privKey *big.Int
+	pubKey  *big.Int
 }
 
-func (p *Peer) generatePublicKey() {
+func (p *Peer) newSession() (*session, error) {
+	prime, err := sharedPrime()
+	if err != nil {
+		return nil, err
+	}
+	priv_key := make([]byte, constants.KEY_LENGTH)
+	if _, err := rand.Read(priv_key); err != nil {
+		return nil, err
+	}
+	privKey := new(big.Int).SetBytes(priv_key)
 	var pub_key big.Int
-	pub_key.Exp(p.Generator, p.PrivKey, p.Prime)
-	p.PubKey = &pub_key
+	pub_key.Exp(p.Generator, privKey, prime)
+	return &session{prime: prime, privKey: privKey, pubKey: &pub_key}, nil
 }
 
-func (p *Peer) getKey(remote_pub_key *big.Int) {
+func (ss *session) getKey(remote_pub_key *big.Int) []byte {
 	var shared_secret big.Int
-	shared_secret.Exp(remote_pub_key, p.PrivKey, p.Prime)
+	shared_secret.Exp(remote_pub_key, ss.privKey, ss.prime)
 	hash := sha256.New()
 	hash.Write(shared_secret.Bytes())
-	p.AesKey = hash.Sum(nil)
+	return hash.Sum(nil)
+}
+
+// proof is a solved handshake puzzle and the session key it was solved for.
+type proof struct {
+	session    *session
+	nonce      int
+	at         int64
+	difficulty int
+}
+
+// proof returns a proof of work for the peer at difficulty or a harder one.
+// The last one is reused, with its session key, for half of
+// ADMISSION_WINDOW so requests in a row don't each mine again.
+func (p *Peer) proof(difficulty int) (*proof, error) {
+	now := time.Now().Unix()
+	p.mu.Lock()
+	cached := p.pow
+	p.mu.Unlock()
+	if cached != nil && cached.difficulty >= difficulty && now-cached.at < constants.ADMISSION_WINDOW/2 {
+		return cached, nil
+	}
+	ss, err := p.newSession()
+	if err != nil {
+		return nil, err
+	}
+	pow := &proof{session: ss, at: now, difficulty: difficulty}
+	pow.nonce = p.calculateNonce(challenge(p.ID, ss.pubKey, now), difficulty)
+	p.mu.Lock()
+	p.pow = pow
+	p.mu.Unlock()
+	return pow, nil
+}
+
+// forgetProof drops the cached proof of work after the peer refused it.
+func (p *Peer) forgetProof() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pow = nil
 }
 
-func (p *Peer) calculateNonce() int {
-	minInt, maxInt := utils.GetTargetRange(len(p.ID), p.Difficulty)
+func (p *Peer) calculateNonce(challenge string, difficulty int) int {
+	minInt, maxInt := utils.GetTargetRange(len(p.ID), difficulty)
 	nonce := 0
 	for {
 		hash := sha1.New()
-		io.WriteString(hash, p.ID+strconv.Itoa(nonce))
+		io.WriteString(hash, challenge+strconv.Itoa(nonce))
 		h := binary.BigEndian.Uint64(hash.Sum(nil))
 		if minInt < h && h < maxInt {
 			return nonce
@@ -76,105 +133,192 @@ func (p *Peer) calculateNonce() int {
 	}
 }
 
+// Copy returns the peer detached from any bucket.
 func (p *Peer) Copy() *Peer {
-	return &Peer{Addr: p.Addr, Difficulty: p.Difficulty}
+	lastSeen, rtt := p.Stats()
+	return &Peer{
+		ID:         p.ID,
+		Addr:       p.Addr,
+		Difficulty: p.difficulty(),
+		Generator:  p.Generator,
+		JoinedAt:   p.JoinedAt,
+		LastLookup: p.LastLookup,
+		LastSeen:   lastSeen,
+		RTT:        rtt,
+	}
 }
 
 func (p *Peer) AsTuple() Tuple {
-	return Tuple{Addr: p.Addr, Difficulty: p.Difficulty}
+	return Tuple{Addr: p.Addr, Difficulty: p.difficulty()}
 }
 
-func (p *Peer) Blacklist() {
-	p.Difficulty = 15
-	conn, err := net.DialUDP("udp", nil, p.Addr)
-	utils.CheckError(err)
-	defer conn.Close()
-	p.Send(conn, "blacklist", []byte(""))
+func (p *Peer) difficulty() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.Difficulty
+}
+
+// Failures is how many requests in a row the peer has not answered.
+func (p *Peer) Failures() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.failures
 }
 
-func (p *Peer) PerformKeyExchange() bool {
-	p.generatePrime()
-	p.generatePrivateKey()
-	p.generatePublicKey()
+// Stats returns when the peer last answered and how long that took.
+func (p *Peer) Stats() (time.Time, time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.LastSeen, p.RTT
+}
 
+// offerKey sends a key offer with a proof of work at the peer's difficulty
+// and returns the peer's answer along with the session it offered.
+func (p *Peer) offerKey(conn *net.UDPConn) (*session, KeyOffer, error) {
+	var reply KeyOffer
+	pow, err := p.proof(p.difficulty())
+	if err != nil {
+		return nil, reply, fmt.Errorf("%w: %v", ErrKeyExchange, err)
+	}
+	ss := pow.session
 	offer := KeyOffer{
 		Type:  "key exchange",
-		Nonce: p.calculateNonce(),
-		Prime: p.Prime,
-		Key:   p.PubKey,
+		Nonce: pow.nonce,
+		Time:  pow.at,
+		Prime: ss.prime,
+		Key:   ss.pubKey,
 	}
-
 	data, err := json.Marshal(offer)
-	utils.CheckError(err)
+	if err != nil {
+		return nil, reply, err
+	}
 	b64 := base64.StdEncoding.EncodeToString(data)
-	conn, err := net.DialUDP("udp", nil, p.Addr)
-	utils.CheckError(err)
-	defer conn.Close()
-	conn.Write([]byte(b64)+[]byte{4})
-	msg = ""
-	for {
-		chunk := make([]byte, constants.BUFFER)
-		_, _, err := conn.ReadFromUDP(chunk)
-		if err != nil {
-			return false
-		}
-		msg += strings.TrimSpace(string(chunk))
-		if strings.Contains(msg, string(4)) {
-			break
-		}
+	conn.SetDeadline(time.Now().Add(constants.REPLY_TIMEOUT * time.Second))
+	if _, err := conn.Write(append([]byte(b64), 4)); err != nil {
+		return nil, reply, err
 	}
-	msg = strings.Replace(msg, string(4), "", -1)
-	byteData, _ := base64.StdEncoding.DecodeString(msg)
-	var jsonData KeyOffer
-	json.Unmarshal(byteData, &jsonData)
-	p.getKey(jsonData.Key)
-	return true
+	msg, _, err := readMessage(conn)
+	if err != nil {
+		return nil, reply, fmt.Errorf("%w: %w", ErrKeyExchange, err)
+	}
+	byteData, err := base64.StdEncoding.DecodeString(msg)
+	if err != nil {
+		return nil, reply, fmt.Errorf("%w: %v", ErrKeyExchange, err)
+	}
+	if err := decode(byteData, &reply); err != nil {
+		return nil, reply, fmt.Errorf("%w: %w", ErrKeyExchange, err)
+	}
+	return ss, reply, nil
 }
 
-func (p *Peer) Send(conn *net.UDPConn, msgType string, msgData []byte) bool {
-	response := p.PerformKeyExchange()
-	if !response {
+// adjustDifficulty follows the difficulty a peer advertised, ignoring ones
+// beyond ADMISSION_MAX_DIFFICULTY that would keep us mining forever. It
+// reports whether the difficulty changed.
+func (p *Peer) adjustDifficulty(difficulty int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if difficulty <= 0 || difficulty > constants.ADMISSION_MAX_DIFFICULTY || difficulty == p.Difficulty {
 		return false
 	}
-	msg := Msg{Type: msgType, Data: msgData}
-	marshalledMsg, err := json.Marshal(msg)
-	utils.CheckError(err)
-	encrypted_data := utils.Encrypt(marshalledMsg, p.AesKey)
-	conn.Write([]byte(encrypted_data)+[]byte{4})
+	p.Difficulty = difficulty
 	return true
 }
 
-func (p *Peer) Receive(conn *net.UDPConn) (string, []byte, *net.UDPAddr, error) {
-	var msg string
-	var addr net.Addr
-	var err error
+// PerformKeyExchange agrees on a session key with the peer over conn, which
+// the request must then be sent on. If the peer asks for more work than we
+// did, the offer is retried once at the difficulty it asked for.
+func (p *Peer) PerformKeyExchange(conn *net.UDPConn) ([]byte, error) {
+	start := time.Now()
+	ss, reply, err := p.offerKey(conn)
+	if err == nil && reply.Type == "difficulty" && p.adjustDifficulty(reply.Difficulty) {
+		ss, reply, err = p.offerKey(conn)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if reply.Type == "difficulty" {
+		p.forgetProof()
+		return nil, fmt.Errorf("%w: %w", ErrKeyExchange, ErrPowFailed)
+	}
+	if reply.Key == nil || reply.Key.Sign() <= 0 {
+		return nil, fmt.Errorf("%w: no public key in reply", ErrKeyExchange)
+	}
+	p.adjustDifficulty(reply.Difficulty)
+	DefaultMetrics.Since("kademlia_handshake_duration_seconds", "", start)
+	return ss.getKey(reply.Key), nil
+}
 
-	for {
-		chunk := make([]byte, constants.BUFFER)
-		_, addr, err = conn.ReadFromUDP(chunk)
+// Send exchanges keys with the peer and sends it a request, returning the
+// session key its reply is encrypted with.
+func (p *Peer) Send(conn *net.UDPConn, msgType string, msgData []byte) ([]byte, error) {
+	key, err := p.PerformKeyExchange(conn)
+	if err != nil {
+		return nil, err
+	}
+	msg := Msg{Type: msgType, Data: msgData, Crawl: p.crawler}
+	marshalledMsg, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	encrypted_data, err := utils.Encrypt(marshalledMsg, key)
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write(append([]byte(encrypted_data), 4))
+	return key, err
+}
 
-		msg += strings.TrimSpace(string(chunk))
-		if strings.Contains(msg, string(4)) {
-			break
-		}
+func (p *Peer) Receive(conn *net.UDPConn, key []byte) (string, []byte, *net.UDPAddr, error) {
+	conn.SetReadDeadline(time.Now().Add(constants.REPLY_TIMEOUT * time.Second))
+	msg, addr, err := readMessage(conn)
+	if err != nil {
+		return "", nil, addr, err
+	}
+	decrypted, err := utils.Decrypt(msg, key)
+	if err != nil {
+		return "", nil, addr, err
 	}
-	msg = strings.Replace(msg, string(4), "", -1)
-	decrypted := utils.Decrypt(msg, p.AesKey)
 
 	var jsonData Msg
-	json.Unmarshal([]byte(decrypted), &jsonData)
-	return jsonData.Type, jsonData.Data, addr.(*net.UDPAddr), err
+	if err := decode([]byte(decrypted), &jsonData); err != nil {
+		return "", nil, addr, err
+	}
+	return jsonData.Type, jsonData.Data, addr, nil
 }
 
 func (p *Peer) SendRecv(msgType string, msgData []byte) (string, []byte, *net.UDPAddr, error) {
 	conn, err := net.DialUDP("udp", nil, p.Addr)
-	utils.CheckError(err)
+	if err != nil {
+		return "", nil, nil, err
+	}
 	defer conn.Close()
-	sent := p.Send(conn, msgType, msgData)
-	if !sent {
-		return "", []byte(""), nil, errors.New("no response")
+	start := time.Now()
+	key, err := p.Send(conn, msgType, msgData)
+	if err != nil {
+		p.failed()
+		DefaultMetrics.Inc("kademlia_rpc_errors_total", Label("type", msgType))
+		return "", nil, nil, fmt.Errorf("%s to %s: %w", msgType, p.Addr, err)
+	}
+	reply, data, addr, err := p.Receive(conn, key)
+	if err != nil {
+		p.failed()
+		DefaultMetrics.Inc("kademlia_rpc_errors_total", Label("type", msgType))
+		return "", nil, addr, fmt.Errorf("%s to %s: %w", msgType, p.Addr, err)
 	}
-	return p.Receive(conn)
+	rtt := time.Since(start)
+	p.mu.Lock()
+	p.LastSeen = time.Now()
+	p.RTT = rtt
+	p.failures = 0
+	p.mu.Unlock()
+	DefaultMetrics.Observe("kademlia_rpc_duration_seconds", Label("type", msgType), rtt.Seconds())
+	return reply, data, addr, nil
+}
+
+func (p *Peer) failed() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.failures += 1
 }
 
 func (p *Peer) Ping() bool {
@@ -188,14 +332,119 @@ func (p *Peer) Ping() bool {
 	return false
 }
 
+// Version asks the peer which version it runs. Peers older than versioned
+// pongs answer with an empty version.
+func (p *Peer) Version() (string, error) {
+	msgType, data, _, err := p.SendRecv("ping", []byte(""))
+	if err != nil {
+		return "", err
+	}
+	if msgType != "pong" {
+		return "", unexpected(msgType)
+	}
+	return string(data), nil
+}
+
 func (p *Peer) FindNode(id string) (string, []byte, *net.UDPAddr, error) {
 	return p.SendRecv("find node", []byte(id))
 }
 
-func (p *Peer) Store(key string, value string) {
+func (p *Peer) AddProvider(key string, provider Tuple, ttl time.Duration) error {
+	data, err := json.Marshal(ProviderRequest{Key: key, Provider: provider, TTL: int(ttl.Seconds())})
+	if err != nil {
+		return err
+	}
+	msgType, reply, _, err := p.SendRecv("add provider", data)
+	if err != nil {
+		return err
+	}
+	if msgType != "stored" {
+		return rejected(reply)
+	}
+	return nil
+}
 
+func (p *Peer) GetProviders(key string) ([]Tuple, []Tuple, error) {
+	msgType, data, _, err := p.SendRecv("get providers", []byte(key))
+	if err != nil {
+		return nil, nil, err
+	}
+	if msgType != "providers" {
+		return nil, nil, unexpected(msgType)
+	}
+	var response ProvidersResponse
+	err = decode(data, &response)
+	return response.Providers, response.Closer, err
 }
 
-func (p *Peer) FindValue(id string) {
+func (p *Peer) StoreRecord(record *Record) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	msgType, reply, _, err := p.SendRecv("store record", data)
+	if err != nil {
+		return err
+	}
+	if msgType != "stored" {
+		return rejected(reply)
+	}
+	return nil
+}
+
+func (p *Peer) FindRecord(key string) (*Record, []Tuple, error) {
+	msgType, data, _, err := p.SendRecv("find record", []byte(key))
+	if err != nil {
+		return nil, nil, err
+	}
+	if msgType == "record" {
+		var record Record
+		err := decode(data, &record)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &record, nil, nil
+	}
+	var neighbors []Tuple
+	err = decode(data, &neighbors)
+	return nil, neighbors, err
+}
+
+func (p *Peer) Store(key string, value []byte) error {
+	return p.store(StoreRequest{Key: key, Value: value})
+}
 
+func (p *Peer) Cache(key string, value []byte, ttl time.Duration) error {
+	return p.store(StoreRequest{Key: key, Value: value, TTL: int(ttl.Seconds())})
+}
+
+func (p *Peer) store(request StoreRequest) error {
+	data, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	msgType, reply, _, err := p.SendRecv("store", data)
+	if err != nil {
+		return err
+	}
+	if msgType != "stored" {
+		return rejected(reply)
+	}
+	return nil
+}
+
+func (p *Peer) FindValue(id string) ([]byte, []Tuple, error) {
+	msgType, data, _, err := p.SendRecv("find value", []byte(id))
+	if err != nil {
+		return nil, nil, err
+	}
+	if msgType == "value" {
+		if err := VerifyContent(id, data); err != nil {
+			return nil, nil, err
+		}
+		return data, nil, nil
+	}
+	var neighbors []Tuple
+	err = decode(data, &neighbors)
+	return nil, neighbors, err
 }
@@ -0,0 +1,21 @@
+package models
+
+import (
+	"time"
+)
+
+type ProviderRecord struct {
+	Provider Tuple
+	Expires  time.Time
+}
+
+type ProviderRequest struct {
+	Key      string `json:"key"`
+	Provider Tuple  `json:"provider"`
+	TTL      int    `json:"ttl"`
+}
+
+type ProvidersResponse struct {
+	Providers []Tuple `json:"providers"`
+	Closer    []Tuple `json:"closer"`
+}
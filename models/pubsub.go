@@ -0,0 +1,284 @@
+package models
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"kademlia/constants"
+	"net"
+	"sync"
+	"time"
+)
+
+// Topic is a named event stream. Mesh holds the subscribed peers events on
+// the topic are exchanged with, similar to a GossipSub mesh.
+type Topic struct {
+	Name      string
+	Mesh      map[string]*Peer
+	Announced time.Time
+}
+
+type PubSub struct {
+	mu     sync.Mutex
+	topics map[string]*Topic
+}
+
+func TopicKey(topic string) string {
+	hash := sha1.New()
+	io.WriteString(hash, "topic:"+topic)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func (ps *PubSub) Topic(name string) *Topic {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.topics[name]
+}
+
+func (ps *PubSub) Topics() []string {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	var names []string
+	for name := range ps.topics {
+		names = append(names, name)
+	}
+	return names
+}
+
+func (ps *PubSub) MeshPeers(name string) []*Peer {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	var peers []*Peer
+	if topic, ok := ps.topics[name]; ok {
+		for _, peer := range topic.Mesh {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+func (ps *PubSub) graft(name string, peer *Peer) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	topic, ok := ps.topics[name]
+	if !ok {
+		return false
+	}
+	if _, ok := topic.Mesh[peer.ID]; !ok && len(topic.Mesh) >= constants.MESH_MAX {
+		return false
+	}
+	topic.Mesh[peer.ID] = peer
+	return true
+}
+
+func (ps *PubSub) prune(name string, id string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if topic, ok := ps.topics[name]; ok {
+		delete(topic.Mesh, id)
+	}
+}
+
+// removePeer drops the peer with id from the mesh of every topic.
+func (ps *PubSub) removePeer(id string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for _, topic := range ps.topics {
+		delete(topic.Mesh, id)
+	}
+}
+
+func (p *Peer) Graft(topic string) (bool, error) {
+	msgType, _, _, err := p.SendRecv("graft", []byte(topic))
+	if err != nil {
+		return false, err
+	}
+	return msgType == "grafted", nil
+}
+
+func (p *Peer) Prune(topic string) error {
+	_, _, _, err := p.SendRecv("prune", []byte(topic))
+	return err
+}
+
+func (p *Peer) Publish(message GossipMessage) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	_, _, _, err = p.SendRecv("publish", data)
+	return err
+}
+
+func (s *Server) senderPeer(addr *net.UDPAddr) *Peer {
+	peer := s.Table.FindPeer(NodeID(addr.IP))
+	if peer != nil {
+		return peer
+	}
+	return Tuple{Addr: &net.UDPAddr{IP: addr.IP, Port: 4444}, Difficulty: 3}.AsPeer()
+}
+
+// JoinTopic subscribes to topic: it announces this node as a provider of the
+// topic key so other subscribers can find it, and grafts onto the mesh of
+// the subscribers it finds.
+func (s *Server) JoinTopic(name string) error {
+	s.Topics.mu.Lock()
+	if s.Topics.topics == nil {
+		s.Topics.topics = make(map[string]*Topic)
+	}
+	if _, ok := s.Topics.topics[name]; ok {
+		s.Topics.mu.Unlock()
+		return nil
+	}
+	s.Topics.topics[name] = &Topic{Name: name, Mesh: make(map[string]*Peer)}
+	s.Topics.mu.Unlock()
+	if err := s.maintainTopic(name); err != nil {
+		s.LeaveTopic(name)
+		return err
+	}
+	return nil
+}
+
+func (s *Server) LeaveTopic(name string) {
+	peers := s.Topics.MeshPeers(name)
+	s.Topics.mu.Lock()
+	delete(s.Topics.topics, name)
+	s.Topics.mu.Unlock()
+	for _, peer := range peers {
+		go peer.Prune(name)
+	}
+}
+
+// maintainTopic re-announces the subscription when it is about to expire
+// and grafts new peers while the mesh is below MESH_SIZE.
+func (s *Server) maintainTopic(name string) error {
+	topic := s.Topics.Topic(name)
+	if topic == nil {
+		return errors.New("not subscribed to " + name)
+	}
+	key := TopicKey(name)
+	if time.Since(topic.Announced) > constants.PROVIDER_TTL*time.Second/2 {
+		if _, err := s.Announce(key); err != nil {
+			return err
+		}
+		s.Topics.mu.Lock()
+		topic.Announced = time.Now()
+		s.Topics.mu.Unlock()
+	}
+	mesh := len(s.Topics.MeshPeers(name))
+	if mesh >= constants.MESH_SIZE {
+		return nil
+	}
+	done := make(chan struct{})
+	defer close(done)
+	for provider := range s.FindProviders(key, constants.MESH_MAX, done) {
+		if mesh >= constants.MESH_SIZE {
+			break
+		}
+		peer := provider.AsPeer()
+		if peer.ID == s.ID {
+			continue
+		}
+		if grafted, err := peer.Graft(name); err == nil && grafted && s.Topics.graft(name, peer) {
+			mesh += 1
+		}
+	}
+	return nil
+}
+
+func (s *Server) topicLoop() {
+	for {
+		time.Sleep(constants.HEARTBEAT * time.Second)
+		for _, name := range s.Topics.Topics() {
+			if err := s.maintainTopic(name); err != nil {
+				s.logger("pubsub").Warn("topic maintenance failed", "topic", name, "err", err)
+			}
+		}
+	}
+}
+
+// Publish sends an already signed event on its topic: to the topic mesh if
+// this node is subscribed, or else directly to some of its subscribers.
+func (s *Server) Publish(event *Event) error {
+	if event.Topic == "" {
+		return errors.New("event has no topic")
+	}
+	if !s.Gossip.timely(event.Time) {
+		return errors.New("event is too old to publish")
+	}
+	message := GossipMessage{ID: MessageID(event), Event: event.AsMsgRequest()}
+	s.Gossip.MarkSeen(message.ID)
+	peers := s.Topics.MeshPeers(event.Topic)
+	if s.Topics.Topic(event.Topic) == nil {
+		done := make(chan struct{})
+		defer close(done)
+		for provider := range s.FindProviders(TopicKey(event.Topic), constants.MESH_SIZE, done) {
+			if peer := provider.AsPeer(); peer.ID != s.ID {
+				peers = append(peers, peer)
+			}
+		}
+	}
+	if len(peers) == 0 {
+		return fmt.Errorf("no subscribers to %s", event.Topic)
+	}
+	for _, peer := range peers {
+		go s.publishTo(peer, message)
+	}
+	return nil
+}
+
+// publishTo sends message to peer, taking it out of the topic meshes once
+// it left LIVENESS_FAILURES requests in a row unanswered.
+func (s *Server) publishTo(peer *Peer, message GossipMessage) {
+	if err := peer.Publish(message); err != nil && peer.Failures() >= constants.LIVENESS_FAILURES {
+		s.Topics.removePeer(peer.ID)
+	}
+}
+
+func (s *Server) handleGraft(addr *net.UDPAddr, key []byte, data []byte) {
+	if s.Topics.graft(string(data), s.senderPeer(addr)) {
+		s.Send(addr, key, "grafted", []byte(""))
+		return
+	}
+	s.Send(addr, key, "pruned", []byte(""))
+}
+
+func (s *Server) handlePrune(addr *net.UDPAddr, key []byte, data []byte) {
+	s.Topics.prune(string(data), NodeID(addr.IP))
+	s.Send(addr, key, "pruned", []byte(""))
+}
+
+func (s *Server) handlePublish(addr *net.UDPAddr, key []byte, data []byte) {
+	s.Send(addr, key, "received", []byte(""))
+	var message GossipMessage
+	if err := decode(data, &message); err != nil {
+		s.fault(addr, err)
+		return
+	}
+	event := message.Event.AsEvent()
+	event.Hash = ""
+	message.ID = MessageID(event)
+	if s.Topics.Topic(event.Topic) == nil || !s.Gossip.timely(event.Time) || s.Gossip.Seen(message.ID) {
+		return
+	}
+	if err := s.Events.Keys.Verify(event); err != nil {
+		return
+	}
+	if !s.Gossip.MarkSeen(message.ID) {
+		return
+	}
+	s.emit(event)
+	sender := NodeID(addr.IP)
+	message.Hops += 1
+	if message.Hops >= s.Gossip.ttl() {
+		return
+	}
+	for _, peer := range s.Topics.MeshPeers(event.Topic) {
+		if peer.ID != sender {
+			go s.publishTo(peer, message)
+		}
+	}
+}
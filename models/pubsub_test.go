@@ -0,0 +1,103 @@
+package models
+
+import (
+	"kademlia/constants"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDeadPeerLeavesMesh(t *testing.T) {
+	s := newTestServer("127.0.0.1")
+	s.Topics.topics = map[string]*Topic{"news": {Name: "news", Mesh: make(map[string]*Peer)}}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2)})
+	if err != nil {
+		t.Skip(err)
+	}
+	addr := conn.LocalAddr().(*net.UDPAddr)
+	conn.Close()
+	dead := Tuple{Addr: addr, Difficulty: 3}.AsPeer()
+	left := testPeers(1)[0]
+	s.Topics.graft("news", dead)
+	s.Topics.graft("news", left)
+
+	message := GossipMessage{ID: "id", Event: (&Event{Topic: "news"}).AsMsgRequest()}
+	for i := 0; i < constants.LIVENESS_FAILURES; i++ {
+		if len(s.Topics.MeshPeers("news")) != 2 {
+			t.Fatalf("peer pruned after %d failures", i)
+		}
+		s.publishTo(dead, message)
+	}
+	if len(s.Topics.MeshPeers("news")) != 1 {
+		t.Fatal("unreachable peer still in the mesh")
+	}
+	s.peerLeft(left)
+	if len(s.Topics.MeshPeers("news")) != 0 {
+		t.Fatal("peer that left still in the mesh")
+	}
+}
+
+// TestTopicReplay publishes a topic event to a subscriber, then replays it
+// once it is older than the seen-cache remembers.
+func TestTopicReplay(t *testing.T) {
+	s := newTestServer("127.0.0.2")
+	author, _ := NewIdentity()
+	s.Events.Keys = &TrustStore{}
+	s.Events.Keys.AddIdentity(author.ID, author.PublicKey(), false)
+	s.Topics.topics = map[string]*Topic{"news": {Name: "news", Mesh: make(map[string]*Peer)}}
+	events := s.Subscribe(EventFilter{Topic: "news"})
+	conn, err := net.ListenUDP("udp", s.Addr)
+	if err != nil {
+		t.Skip(err)
+	}
+	go s.Serve(conn)
+	t.Cleanup(func() { conn.Close() })
+
+	publish := func(at time.Time) bool {
+		t.Helper()
+		event := &Event{Topic: "news", Time: at.Unix(), Data: "hello"}
+		author.Sign(event)
+		if err := testPeer(s).Publish(GossipMessage{ID: MessageID(event), Event: event.AsMsgRequest()}); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-events:
+			return true
+		case <-time.After(200 * time.Millisecond):
+			return false
+		}
+	}
+	if !publish(time.Now()) {
+		t.Fatal("fresh topic event not delivered")
+	}
+	if publish(time.Now().Add(-constants.GOSSIP_SEEN_TTL * time.Second)) {
+		t.Fatal("topic event older than the seen TTL delivered")
+	}
+	if publish(time.Now().Add(constants.GOSSIP_SEEN_TTL * time.Second)) {
+		t.Fatal("topic event from the future delivered")
+	}
+
+	event := &Event{Topic: "news", Time: time.Now().Unix(), Data: "hello"}
+	author.Sign(event)
+	event.Time -= constants.GOSSIP_SEEN_TTL
+	if err := s.Events.Keys.Verify(event); err == nil {
+		t.Fatal("changing the time of a signed topic event kept it valid")
+	}
+}
+
+func TestJoinTopicUndone(t *testing.T) {
+	s := newTestServer("127.0.0.1")
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2)})
+	if err != nil {
+		t.Skip(err)
+	}
+	addr := conn.LocalAddr().(*net.UDPAddr)
+	conn.Close()
+	s.Table.AddPeer(Tuple{Addr: addr, Difficulty: 3}.AsPeer())
+	if err := s.JoinTopic("news"); err == nil {
+		t.Fatal("joined a topic no peer accepted the announcement of")
+	}
+	if s.Topics.Topic("news") != nil {
+		t.Fatal("topic still registered after joining failed")
+	}
+}
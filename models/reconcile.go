@@ -0,0 +1,352 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kademlia/constants"
+	"kademlia/utils"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Event and value sets are reconciled over a Merkle tree keyed by hash
+// prefix: the node for a prefix covers every item whose hex hash starts with
+// it, and has one child per following hex digit. Peers compare children level
+// by level and only descend into subtrees whose digests differ, exchanging
+// item lists once a subtree is small enough.
+
+var hexDigits = "0123456789abcdef"
+
+type MerkleRequest struct {
+	Set    string `json:"set"`
+	Prefix string `json:"prefix"`
+}
+
+type MerkleNode struct {
+	Prefix string `json:"p"`
+	Digest string `json:"d"`
+	Count  int    `json:"n"`
+}
+
+func prefixRange(sorted []string, prefix string) []string {
+	lo := sort.SearchStrings(sorted, prefix)
+	hi := lo
+	for hi < len(sorted) && strings.HasPrefix(sorted[hi], prefix) {
+		hi += 1
+	}
+	return sorted[lo:hi]
+}
+
+func merkleNode(sorted []string, prefix string) MerkleNode {
+	items := prefixRange(sorted, prefix)
+	node := MerkleNode{Prefix: prefix, Count: len(items)}
+	if root := utils.MerkleRoot(items); len(root) >= 16 {
+		node.Digest = root[:16]
+	} else {
+		node.Digest = root
+	}
+	return node
+}
+
+func merkleChildren(sorted []string, prefix string) []MerkleNode {
+	var children []MerkleNode
+	for _, digit := range hexDigits {
+		children = append(children, merkleNode(sorted, prefix+string(digit)))
+	}
+	return children
+}
+
+// reconcileSet returns the sorted items of set to reconcile with the node
+// with id: every event, but only the values both nodes are responsible for.
+func (s *Server) reconcileSet(set string, id string) ([]string, error) {
+	if set == "events" {
+		return s.Events.Hashes(), nil
+	}
+	if set == "values" {
+		return s.sharedKeys(s.Values.Keys(), id), nil
+	}
+	return nil, fmt.Errorf("unknown set %q", set)
+}
+
+// sharedKeys returns the keys for which both this node and the node with id
+// are among the K closest nodes this node knows of.
+func (s *Server) sharedKeys(keys []string, id string) []string {
+	peers := s.Table.ListPeers()
+	var shared []string
+	for _, key := range keys {
+		farthest := utils.Distance(s.ID, key)
+		if distance := utils.Distance(id, key); distance > farthest {
+			farthest = distance
+		}
+		closer := 0
+		for _, peer := range peers {
+			if peer.ID != id && utils.Distance(peer.ID, key) < farthest {
+				closer += 1
+			}
+		}
+		if closer < s.Table.K-1 {
+			shared = append(shared, key)
+		}
+	}
+	return shared
+}
+
+func (p *Peer) MerkleChildren(set string, prefix string) ([]MerkleNode, error) {
+	data, err := json.Marshal(MerkleRequest{Set: set, Prefix: prefix})
+	if err != nil {
+		return nil, err
+	}
+	msgType, reply, _, err := p.SendRecv("merkle children", data)
+	if err != nil {
+		return nil, err
+	}
+	if msgType != "merkle" {
+		return nil, unexpected(msgType)
+	}
+	var children []MerkleNode
+	err = decode(reply, &children)
+	return children, err
+}
+
+func (p *Peer) MerkleLeaves(set string, prefix string) ([]string, error) {
+	data, err := json.Marshal(MerkleRequest{Set: set, Prefix: prefix})
+	if err != nil {
+		return nil, err
+	}
+	msgType, reply, _, err := p.SendRecv("merkle leaves", data)
+	if err != nil {
+		return nil, err
+	}
+	if msgType != "leaves" {
+		return nil, unexpected(msgType)
+	}
+	var leaves []string
+	err = decode(reply, &leaves)
+	return leaves, err
+}
+
+func (p *Peer) GetEvent(hash string) (*Event, error) {
+	msgType, data, _, err := p.SendRecv("get event", []byte(hash))
+	if err != nil {
+		return nil, err
+	}
+	if msgType != "event" {
+		return nil, ErrNotFound
+	}
+	var event Event
+	if err := decode(data, &event); err != nil {
+		return nil, err
+	}
+	if event.Hash != hash {
+		return nil, ErrBadHash
+	}
+	return &event, nil
+}
+
+func (s *Server) handleMerkleChildren(addr *net.UDPAddr, key []byte, data []byte) {
+	var request MerkleRequest
+	if err := decode(data, &request); err != nil {
+		s.fault(addr, err)
+		return
+	}
+	sorted, err := s.reconcileSet(request.Set, NodeID(addr.IP))
+	if err != nil {
+		s.Send(addr, key, "rejected", []byte(err.Error()))
+		return
+	}
+	msg, err := json.Marshal(merkleChildren(sorted, request.Prefix))
+	if err != nil {
+		return
+	}
+	s.Send(addr, key, "merkle", msg)
+}
+
+func (s *Server) handleMerkleLeaves(addr *net.UDPAddr, key []byte, data []byte) {
+	var request MerkleRequest
+	if err := decode(data, &request); err != nil {
+		s.fault(addr, err)
+		return
+	}
+	sorted, err := s.reconcileSet(request.Set, NodeID(addr.IP))
+	if err != nil {
+		s.Send(addr, key, "rejected", []byte(err.Error()))
+		return
+	}
+	leaves := prefixRange(sorted, request.Prefix)
+	if len(leaves) > constants.RECONCILE_LEAF {
+		leaves = leaves[:constants.RECONCILE_LEAF]
+	}
+	msg, err := json.Marshal(leaves)
+	if err != nil {
+		return
+	}
+	s.Send(addr, key, "leaves", msg)
+}
+
+func (s *Server) handleGetEvent(addr *net.UDPAddr, key []byte, data []byte) {
+	event := s.Events.Get(string(data))
+	if event == nil {
+		s.Send(addr, key, "missing", []byte(""))
+		return
+	}
+	msg, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	s.Send(addr, key, "event", msg)
+}
+
+// Reconcile walks the Merkle tree of set under prefix together with peer and
+// exchanges only the items one side is missing. For "values" only the keys
+// both nodes are responsible for are compared, and the prefix selects the
+// DHT key range to repair. At most RECONCILE_BATCH items are pushed per
+// call, the rest are left to the next round.
+func (s *Server) Reconcile(peer *Peer, set string, prefix string) error {
+	local, err := s.reconcileSet(set, peer.ID)
+	if err != nil {
+		return err
+	}
+	budget := constants.RECONCILE_BATCH
+	queue := []string{prefix}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		remote, err := peer.MerkleChildren(set, current)
+		if err != nil {
+			return err
+		}
+		for _, theirs := range remote {
+			ours := merkleNode(local, theirs.Prefix)
+			if ours.Digest == theirs.Digest {
+				continue
+			}
+			if ours.Count > constants.RECONCILE_LEAF && theirs.Count > constants.RECONCILE_LEAF {
+				queue = append(queue, theirs.Prefix)
+				continue
+			}
+			if err := s.reconcileLeaves(peer, set, theirs, prefixRange(local, theirs.Prefix), &budget); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Server) reconcileLeaves(peer *Peer, set string, theirs MerkleNode, ours []string, budget *int) error {
+	var remote []string
+	if theirs.Count > 0 {
+		var err error
+		remote, err = peer.MerkleLeaves(set, theirs.Prefix)
+		if err != nil {
+			return err
+		}
+	}
+	have := make(map[string]bool)
+	for _, item := range ours {
+		have[item] = true
+	}
+	for _, item := range remote {
+		if !have[item] && (set != "values" || len(s.sharedKeys([]string{item}, peer.ID)) == 1) {
+			s.pull(peer, set, item)
+		}
+		delete(have, item)
+	}
+	if theirs.Count <= constants.RECONCILE_LEAF {
+		var missing []string
+		for item := range have {
+			missing = append(missing, item)
+		}
+		s.push(peer, set, missing, budget)
+	}
+	return nil
+}
+
+// pull fetches an item the peer has and we don't. Events are fetched along
+// with any unknown ancestors so they can be linked.
+func (s *Server) pull(peer *Peer, set string, item string) {
+	if set == "values" {
+		value, _, err := peer.FindValue(item)
+		if err == nil && value != nil {
+			s.Values.Put(item, value)
+		}
+		return
+	}
+	var pending []*Event
+	hash := item
+	for len(pending) < constants.RECONCILE_DEPTH {
+		event, err := peer.GetEvent(hash)
+		if err != nil {
+			return
+		}
+		pending = append(pending, event)
+		err = s.Events.Validate(event)
+		if !errors.Is(err, ErrUnknownPrev) {
+			break
+		}
+		hash = event.PrevHash
+	}
+	for i := len(pending) - 1; i >= 0; i-- {
+		err := s.Events.Add(pending[i])
+		if err == nil {
+			s.emit(pending[i])
+		} else if !errors.Is(err, ErrDuplicate) {
+			return
+		}
+	}
+}
+
+// push sends the peer items it is missing. Events are sent parents first
+// with an exhausted hop count so the peer adds them without re-gossiping.
+// No more than budget items are sent, and budget is reduced by as many.
+func (s *Server) push(peer *Peer, set string, items []string, budget *int) {
+	if set == "values" {
+		if len(items) > *budget {
+			items = items[:*budget]
+		}
+		*budget -= len(items)
+		for _, item := range items {
+			if value := s.Values.Get(item); value != nil {
+				peer.Store(item, value)
+			}
+		}
+		return
+	}
+	var events []*Event
+	for _, item := range items {
+		if event := s.Events.Get(item); event != nil {
+			events = append(events, event)
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Height < events[j].Height
+	})
+	if len(events) > *budget {
+		events = events[:*budget]
+	}
+	*budget -= len(events)
+	for _, event := range events {
+		peer.Gossip(GossipMessage{ID: event.Hash, Hops: s.Gossip.ttl(), Event: event.AsMsgRequest()})
+	}
+}
+
+// reconcileLoop reconciles events with a random peer and values with a
+// random one of the K closest, which share the most keys with this node.
+func (s *Server) reconcileLoop() {
+	for {
+		time.Sleep(constants.RECONCILE_INTERVAL * time.Second)
+		for _, peer := range s.randomPeers(1, "") {
+			if err := s.Reconcile(peer, "events", ""); err != nil {
+				s.logger("reconcile").Debug("reconcile failed", "peer", peer.ID, "set", "events", "err", err)
+			}
+		}
+		for _, peer := range Shuffle(s.Table.FindKClosest(s.ID, s.Table.K)) {
+			if err := s.Reconcile(peer, "values", ""); err != nil {
+				s.logger("reconcile").Debug("reconcile failed", "peer", peer.ID, "set", "values", "err", err)
+			}
+			break
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package models
+
+import (
+	"fmt"
+	"kademlia/utils"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestReconcileSharedValues checks that values are only pushed to a peer
+// that is among the K closest to their key, as this node sees it.
+func TestReconcileSharedValues(t *testing.T) {
+	a := startTestServer(t, "127.0.0.1")
+	b := startTestServer(t, "127.0.0.2")
+	a.Table.K = 2
+	a.Table.AddPeer(testPeer(b))
+
+	other := []byte("closer to another node")
+	otherKey := ContentKey(other)
+	closer := Tuple{Addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 3), Port: 4444}}.AsPeer()
+	closer.ID = otherKey[:40]
+	a.Table.AddPeer(closer)
+
+	var shared []byte
+	for i := 0; shared == nil; i++ {
+		value := []byte(fmt.Sprint("shared ", i))
+		key := ContentKey(value)
+		farthest := utils.Distance(a.ID, key)
+		if distance := utils.Distance(b.ID, key); distance > farthest {
+			farthest = distance
+		}
+		if utils.Distance(closer.ID, key) > farthest {
+			shared = value
+		}
+	}
+	for _, value := range [][]byte{other, shared} {
+		if err := a.Values.Put(ContentKey(value), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := a.Reconcile(testPeer(b), "values", ""); err != nil {
+		t.Fatal(err)
+	}
+	if b.Values.Get(ContentKey(shared)) == nil {
+		t.Fatal("shared value not pushed")
+	}
+	if b.Values.Get(otherKey) != nil {
+		t.Fatal("value another node is closer to was pushed")
+	}
+}
+
+// TestPushBatch checks that push sends no more events than its budget,
+// lowest heights first, so the rest can follow in the next round.
+func TestPushBatch(t *testing.T) {
+	identity, _ := NewIdentity()
+	a := newTestServer("127.0.0.1")
+	b := startTestServer(t, "127.0.0.2")
+	var hashes []string
+	for _, s := range []*Server{a, b} {
+		s.Events.Difficulty = 1
+		s.Events.Keys = &TrustStore{}
+		s.Events.Keys.AddIdentity(identity.ID, identity.PublicKey(), false)
+	}
+	for i := 0; i < 8; i++ {
+		event := identity.SignEvent("", fmt.Sprint("event ", i))
+		if err := a.Events.Append(event); err != nil {
+			t.Fatal(err)
+		}
+		hashes = append([]string{event.Hash}, hashes...)
+	}
+
+	budget := 3
+	a.push(testPeer(b), "events", hashes, &budget)
+	time.Sleep(200 * time.Millisecond)
+	if budget != 0 || b.Events.Len() != 3 {
+		t.Fatalf("pushed %d events, %d left of the budget", b.Events.Len(), budget)
+	}
+	a.push(testPeer(b), "events", hashes, &budget)
+	time.Sleep(200 * time.Millisecond)
+	if b.Events.Len() != 3 {
+		t.Fatalf("pushed %d events without a budget", b.Events.Len())
+	}
+}
@@ -0,0 +1,52 @@
+package models
+
+import (
+	"crypto/ed25519"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"kademlia/constants"
+)
+
+// Record is a mutable value owned by an ed25519 key, modelled on BEP 44.
+// It lives under the hash of its public key and salt and can only be
+// replaced by a record signed with the same key and a higher sequence number.
+type Record struct {
+	PubKey    ed25519.PublicKey `json:"pub_key"`
+	Salt      string            `json:"salt"`
+	Seq       int64             `json:"seq"`
+	Value     []byte            `json:"value"`
+	Signature []byte            `json:"signature"`
+}
+
+func RecordKey(pubKey ed25519.PublicKey, salt string) string {
+	hash := sha1.New()
+	hash.Write(pubKey)
+	io.WriteString(hash, salt)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func (r *Record) Key() string {
+	return RecordKey(r.PubKey, r.Salt)
+}
+
+func (r *Record) signedData() []byte {
+	data := fmt.Sprintf("4:salt%d:%s3:seqi%de1:v%d:", len(r.Salt), r.Salt, r.Seq, len(r.Value))
+	return append([]byte(data), r.Value...)
+}
+
+func (r *Record) Sign(privKey ed25519.PrivateKey) {
+	r.PubKey = privKey.Public().(ed25519.PublicKey)
+	r.Signature = ed25519.Sign(privKey, r.signedData())
+}
+
+func (r *Record) Verify() error {
+	if len(r.Value) > constants.MAX_VALUE_SIZE {
+		return ErrValueTooBig
+	}
+	if len(r.PubKey) != ed25519.PublicKeySize || !ed25519.Verify(r.PubKey, r.signedData(), r.Signature) {
+		return ErrBadSignature
+	}
+	return nil
+}
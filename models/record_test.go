@@ -0,0 +1,142 @@
+package models
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+)
+
+func signedRecord(privKey ed25519.PrivateKey, seq int64, value string) *Record {
+	record := &Record{Salt: "endpoint", Seq: seq, Value: []byte(value)}
+	record.Sign(privKey)
+	return record
+}
+
+func TestRecordSeq(t *testing.T) {
+	_, privKey, _ := ed25519.GenerateKey(rand.Reader)
+	var vs ValueStore
+	if err := vs.PutRecord(signedRecord(privKey, 1, "a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := vs.PutRecord(signedRecord(privKey, 1, "a")); err != nil {
+		t.Fatalf("storing the same record again gave %v", err)
+	}
+	for _, stale := range []*Record{signedRecord(privKey, 1, "b"), signedRecord(privKey, 0, "b")} {
+		if err := vs.PutRecord(stale); !errors.Is(err, ErrStaleRecord) {
+			t.Fatalf("record with seq %d gave %v", stale.Seq, err)
+		}
+	}
+	if err := vs.PutRecord(signedRecord(privKey, 2, "b")); err != nil {
+		t.Fatal(err)
+	}
+	if record := vs.GetRecord(RecordKey(privKey.Public().(ed25519.PublicKey), "endpoint")); record.Seq != 2 || string(record.Value) != "b" {
+		t.Fatalf("holding seq %d", record.Seq)
+	}
+}
+
+func TestRecordSignature(t *testing.T) {
+	_, privKey, _ := ed25519.GenerateKey(rand.Reader)
+	otherKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	tampered := signedRecord(privKey, 1, "a")
+	tampered.Value = []byte("b")
+	stolen := signedRecord(privKey, 1, "a")
+	stolen.PubKey = otherKey
+	bumped := signedRecord(privKey, 1, "a")
+	bumped.Seq = 5
+	var vs ValueStore
+	for _, record := range []*Record{tampered, stolen, bumped} {
+		if err := vs.PutRecord(record); !errors.Is(err, ErrBadSignature) {
+			t.Fatalf("forged record gave %v", err)
+		}
+	}
+
+	s := startTestServer(t, "127.0.0.2")
+	if err := testPeer(s).StoreRecord(bumped); err == nil {
+		t.Fatal("node accepted a forged record")
+	}
+}
+
+// TestPublishRecord checks that publishing bumps the sequence number and
+// that readers skip records that don't verify.
+func TestPublishRecord(t *testing.T) {
+	_, privKey, _ := ed25519.GenerateKey(rand.Reader)
+	a := startTestServer(t, "127.0.0.2")
+	client := newTestServer("127.0.0.3")
+	client.Table.AddPeer(testPeer(a))
+	for seq, value := range []string{"first", "second"} {
+		record, err := client.PublishRecord(privKey, "endpoint", []byte(value))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if record.Seq != int64(seq) {
+			t.Fatalf("published seq %d, want %d", record.Seq, seq)
+		}
+	}
+
+	key := RecordKey(privKey.Public().(ed25519.PublicKey), "endpoint")
+	forged := signedRecord(privKey, 1, "second")
+	forged.Seq = 9
+	a.Values.mu.Lock()
+	a.Values.records[key].record = forged
+	a.Values.mu.Unlock()
+	reader := newTestServer("127.0.0.4")
+	reader.Table.AddPeer(testPeer(a))
+	if record := reader.GetRecord(key); record != nil {
+		t.Fatalf("reader took a forged record with seq %d", record.Seq)
+	}
+}
+
+func TestRecordLimits(t *testing.T) {
+	vs := ValueStore{MaxRecords: 3}
+	var keys []string
+	for i := 0; i < 4; i++ {
+		_, privKey, _ := ed25519.GenerateKey(rand.Reader)
+		record := signedRecord(privKey, 1, "a")
+		keys = append(keys, record.Key())
+		err := vs.PutRecord(record)
+		if i < 3 && err != nil {
+			t.Fatal(err)
+		}
+		if i == 3 && !errors.Is(err, ErrStoreFull) {
+			t.Fatalf("storing beyond the limit gave %v", err)
+		}
+	}
+	_, ownKey, _ := ed25519.GenerateKey(rand.Reader)
+	own := signedRecord(ownKey, 1, "mine")
+	if err := vs.PublishRecord(own); err != nil {
+		t.Fatalf("publishing on a full store: %v", err)
+	}
+
+	vs.records[keys[0]].expires = time.Now().Add(-time.Second)
+	vs.records[own.Key()].expires = time.Now().Add(-time.Second)
+	if vs.GetRecord(keys[0]) != nil {
+		t.Fatal("expired record returned")
+	}
+	if vs.GetRecord(own.Key()) == nil {
+		t.Fatal("published record expired")
+	}
+	_, privKey, _ := ed25519.GenerateKey(rand.Reader)
+	if err := vs.PutRecord(signedRecord(privKey, 1, "b")); err != nil {
+		t.Fatalf("storing after a record expired: %v", err)
+	}
+	if published := vs.PublishedRecords(); len(published) != 1 || published[0] != own {
+		t.Fatalf("published %v", published)
+	}
+}
+
+func TestRepublishRecord(t *testing.T) {
+	_, privKey, _ := ed25519.GenerateKey(rand.Reader)
+	a := startTestServer(t, "127.0.0.2")
+	record, err := a.PublishRecord(privKey, "endpoint", []byte("here"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := startTestServer(t, "127.0.0.3")
+	a.Table.AddPeer(testPeer(b))
+	a.republish()
+	if got := b.Values.GetRecord(record.Key()); got == nil || got.Seq != record.Seq {
+		t.Fatal("record not republished to a new close node")
+	}
+}
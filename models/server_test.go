@@ -0,0 +1,161 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"kademlia/utils"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestServer returns a node on ip port 4444 that doesn't listen yet.
+func newTestServer(ip string) *Server {
+	addr := &net.UDPAddr{IP: net.ParseIP(ip), Port: 4444}
+	return &Server{
+		Addr:       addr,
+		ID:         NodeID(addr.IP),
+		Table:      RoutingTable{K: 20},
+		Events:     EventChain{Difficulty: 3},
+		Generator:  big.NewInt(5),
+		Difficulty: 3,
+		A:          3,
+	}
+}
+
+// startTestServer starts a node on ip that serves until the test ends.
+func startTestServer(t *testing.T, ip string) *Server {
+	t.Helper()
+	s := newTestServer(ip)
+	conn, err := net.ListenUDP("udp", s.Addr)
+	if err != nil {
+		t.Skipf("can't listen on %s: %v", s.Addr, err)
+	}
+	go s.Serve(conn)
+	t.Cleanup(func() { conn.Close() })
+	return s
+}
+
+func testPeer(s *Server) *Peer {
+	return s.AsTuple().AsPeer()
+}
+
+func TestPutGet(t *testing.T) {
+	a := startTestServer(t, "127.0.0.1")
+	b := startTestServer(t, "127.0.0.2")
+	a.Table.AddPeer(testPeer(b))
+
+	value := []byte("hello kademlia")
+	key, err := a.Put(value)
+	if err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if !bytes.Equal(b.Values.Get(key), value) {
+		t.Fatalf("value not replicated to %s", b.ID)
+	}
+
+	client := newTestServer("127.0.0.3")
+	client.Table.AddPeer(testPeer(b))
+	got, err := client.Get(key)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if !bytes.Equal(got, value) {
+		t.Fatalf("got %q, want %q", got, value)
+	}
+}
+
+// TestInterleavedClients sends a second key offer while the server waits
+// for the first client's request, which must still reach both.
+func TestInterleavedClients(t *testing.T) {
+	s := startTestServer(t, "127.0.0.1")
+	first, second := testPeer(s), testPeer(s)
+	if _, err := sharedPrime(); err != nil {
+		t.Fatal(err)
+	}
+
+	conn1, err := net.DialUDP("udp", nil, s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn1.Close()
+	conn2, err := net.DialUDP("udp", nil, s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+
+	key, err := first.PerformKeyExchange(conn1)
+	if err != nil {
+		t.Fatalf("first key exchange: %v", err)
+	}
+	done := make(chan error)
+	var secondKey []byte
+	go func() {
+		var err error
+		secondKey, err = second.Send(conn2, "ping", nil)
+		done <- err
+	}()
+	// Give the second offer time to arrive before the first request.
+	time.Sleep(200 * time.Millisecond)
+	request, _ := json.Marshal(Msg{Type: "ping"})
+	encrypted, err := utils.Encrypt(request, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn1.Write(append([]byte(encrypted), 4)); err != nil {
+		t.Fatal(err)
+	}
+	if msgType, _, _, err := first.Receive(conn1, key); err != nil || msgType != "pong" {
+		t.Fatalf("first client got %q, %v", msgType, err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("second send: %v", err)
+	}
+	if msgType, _, _, err := second.Receive(conn2, secondKey); err != nil || msgType != "pong" {
+		t.Fatalf("second client got %q, %v", msgType, err)
+	}
+}
+
+func TestSyncDivergedPeer(t *testing.T) {
+	identity, _ := NewIdentity()
+	a := newTestServer("127.0.0.1")
+	b := startTestServer(t, "127.0.0.2")
+	for _, s := range []*Server{a, b} {
+		s.Events.Difficulty = 1
+		s.Events.Keys = &TrustStore{}
+		s.Events.Keys.AddIdentity(identity.ID, identity.PublicKey(), false)
+	}
+	for i := 0; i < 40; i++ {
+		if err := b.Events.Append(identity.SignEvent("", fmt.Sprint("shared ", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, event := range b.Events.Range(0, 39) {
+		if err := a.Events.Add(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if err := a.Events.Append(identity.SignEvent("", fmt.Sprint("a ", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		if err := b.Events.Append(identity.SignEvent("", fmt.Sprint("b ", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := a.SyncEvents(testPeer(b)); err != nil {
+		t.Fatal(err)
+	}
+	if a.Events.Last().Hash != b.Events.Last().Hash {
+		t.Fatalf("chain ends at height %d, the peer's at %d", a.Events.Last().Height, b.Events.Last().Height)
+	}
+	if a.Events.At(40).Data != "b 0" {
+		t.Fatalf("height 40 holds %q", a.Events.At(40).Data)
+	}
+}
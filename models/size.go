@@ -0,0 +1,102 @@
+package models
+
+import (
+	"kademlia/constants"
+	"kademlia/utils"
+	"math"
+	"sync"
+)
+
+// SizeEstimate is the estimated number of nodes in the network, from this
+// node's routing table and from recent lookups.
+type SizeEstimate struct {
+	Estimate float64 `json:"estimate"`
+	Table    float64 `json:"table"`
+	Lookups  float64 `json:"lookups"`
+	Samples  int     `json:"samples"`
+	Replicas int     `json:"replicas"`
+}
+
+// SizeEstimator keeps the estimates derived from the last SIZE_SAMPLES
+// lookups.
+type SizeEstimator struct {
+	mu      sync.Mutex
+	samples []float64
+}
+
+func (e *SizeEstimator) add(estimate float64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.samples = append(e.samples, estimate)
+	if len(e.samples) > constants.SIZE_SAMPLES {
+		e.samples = e.samples[len(e.samples)-constants.SIZE_SAMPLES:]
+	}
+}
+
+// mean returns the average of the samples and how many there are.
+func (e *SizeEstimator) mean() (float64, int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.samples) == 0 {
+		return 0, 0
+	}
+	sum := 0.0
+	for _, sample := range e.samples {
+		sum += sample
+	}
+	return sum / float64(len(e.samples)), len(e.samples)
+}
+
+// estimateSize estimates the network size from the peers closest to id,
+// sorted by distance. With N nodes spread uniformly over the keyspace the
+// i-th closest is expected at a distance of i/N of the keyspace, so N is
+// fitted by least squares to the observed distances. The estimate is never
+// below the number of nodes actually seen.
+func estimateSize(id string, closest []*Peer) float64 {
+	if len(closest) == 0 {
+		return 1
+	}
+	squares, weighted := 0.0, 0.0
+	for i, peer := range closest {
+		rank := float64(i + 1)
+		distance := float64(utils.Distance(peer.ID, id)) / math.MaxUint64
+		squares += rank * rank
+		weighted += rank * distance
+	}
+	estimate := float64(len(closest) + 1)
+	if weighted > 0 && squares/weighted > estimate {
+		estimate = squares / weighted
+	}
+	return estimate
+}
+
+// NetworkSize averages the estimate from the peers closest to this node
+// with the ones recorded by recent lookups.
+func (s *Server) NetworkSize() SizeEstimate {
+	var closest []*Peer
+	if !s.Table.Empty() {
+		closest = s.Table.FindKClosest(s.ID, s.Table.K)
+	}
+	size := SizeEstimate{Table: estimateSize(s.ID, closest)}
+	size.Lookups, size.Samples = s.Size.mean()
+	size.Estimate = (size.Table + size.Lookups*float64(size.Samples)) / float64(size.Samples+1)
+	size.Replicas = s.replicas(size.Estimate)
+	return size
+}
+
+// replicas is how many of the closest peers a value is stored on. With
+// AdaptiveReplication it grows with the logarithm of the network size,
+// between MIN_REPLICAS and K; otherwise it is K.
+func (s *Server) replicas(size float64) int {
+	if !s.AdaptiveReplication {
+		return s.Table.K
+	}
+	replicas := int(math.Ceil(2 * math.Log2(size)))
+	if replicas < constants.MIN_REPLICAS {
+		replicas = constants.MIN_REPLICAS
+	}
+	if replicas > s.Table.K {
+		replicas = s.Table.K
+	}
+	return replicas
+}
@@ -0,0 +1,72 @@
+package models
+
+import (
+	"fmt"
+	"kademlia/constants"
+	"math"
+	"strings"
+	"testing"
+)
+
+// spacedPeers returns the count closest of size nodes spread evenly over
+// the keyspace, as seen from the all-zero ID.
+func spacedPeers(size int, count int) []*Peer {
+	var peers []*Peer
+	for i := 1; i <= count; i++ {
+		distance := uint64(float64(i) / float64(size) * math.MaxUint64)
+		peers = append(peers, &Peer{ID: fmt.Sprintf("%016x", distance) + strings.Repeat("0", 24)})
+	}
+	return peers
+}
+
+func TestEstimateSize(t *testing.T) {
+	id := strings.Repeat("0", 40)
+	tests := []struct {
+		size  int
+		count int
+	}{
+		{50, 20},
+		{1000, 20},
+		{100000, 20},
+		{1000000, 8},
+	}
+	for _, test := range tests {
+		estimate := estimateSize(id, spacedPeers(test.size, test.count))
+		if math.Abs(estimate-float64(test.size)) > 0.01*float64(test.size) {
+			t.Errorf("%d nodes estimated as %.0f", test.size, estimate)
+		}
+	}
+	if estimate := estimateSize(id, nil); estimate != 1 {
+		t.Errorf("no peers estimated as %.0f", estimate)
+	}
+	var far []*Peer
+	for i := 0; i < 20; i++ {
+		far = append(far, &Peer{ID: strings.Repeat("f", 40)})
+	}
+	if estimate := estimateSize(id, far); estimate != 21 {
+		t.Errorf("20 far peers estimated as %.0f nodes", estimate)
+	}
+}
+
+func TestReplicas(t *testing.T) {
+	s := newTestServer("127.0.0.1")
+	if replicas := s.replicas(4); replicas != s.Table.K {
+		t.Fatalf("without adaptive replication got %d replicas", replicas)
+	}
+	s.AdaptiveReplication = true
+	tests := []struct {
+		size     float64
+		replicas int
+	}{
+		{1, constants.MIN_REPLICAS},
+		{2, constants.MIN_REPLICAS},
+		{8, 6},
+		{100, 14},
+		{1e12, s.Table.K},
+	}
+	for _, test := range tests {
+		if replicas := s.replicas(test.size); replicas != test.replicas {
+			t.Errorf("%.0f nodes got %d replicas, want %d", test.size, replicas, test.replicas)
+		}
+	}
+}
@@ -0,0 +1,7 @@
+package models
+
+type StoreRequest struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+	TTL   int    `json:"ttl,omitempty"`
+}
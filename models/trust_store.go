@@ -0,0 +1,220 @@
+package models
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+var ErrUnknownAuthor = errors.New("unknown author")
+
+type AuthorKey struct {
+	ID    string            `json:"id"`
+	Key   ed25519.PublicKey `json:"key"`
+	Admin bool              `json:"admin"`
+}
+
+// TrustUpdate is the payload of a "trust" event. Op is "add" or "remove",
+// which only admins may publish, or "rotate", which an author publishes
+// with its current key to replace it by Key. Proof is Key's signature of
+// the rotation, so a key can't be rotated to one nobody holds.
+type TrustUpdate struct {
+	Op    string            `json:"op"`
+	Key   ed25519.PublicKey `json:"key,omitempty"`
+	ID    string            `json:"id,omitempty"`
+	Admin bool              `json:"admin,omitempty"`
+	Proof []byte            `json:"proof,omitempty"`
+}
+
+// TrustStore holds the ed25519 keys allowed to publish events, indexed by
+// key ID: the configured base keys with the trust events of the canonical
+// chain applied on top.
+type TrustStore struct {
+	mu   sync.RWMutex
+	base map[string]*AuthorKey
+	keys map[string]*AuthorKey
+}
+
+func KeyID(key ed25519.PublicKey) string {
+	hash := sha1.New()
+	hash.Write(key)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// LoadFile adds the keys listed in path, one base64 encoded public key per
+// line optionally followed by "admin". Blank lines and lines starting with
+// # are ignored.
+func (ts *TrustStore) LoadFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	line := 0
+	for scanner.Scan() {
+		line += 1
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[0])
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return fmt.Errorf("%s:%d: invalid public key", path, line)
+		}
+		ts.Add(key, len(fields) > 1 && fields[1] == "admin")
+	}
+	return scanner.Err()
+}
+
+func (ts *TrustStore) Add(key ed25519.PublicKey, admin bool) string {
+	id := KeyID(key)
+	ts.AddIdentity(id, key, admin)
+	return id
+}
+
+// AddIdentity trusts key under id, which differs from the key's own ID
+// once an identity has rotated its key.
+func (ts *TrustStore) AddIdentity(id string, key ed25519.PublicKey, admin bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.base == nil {
+		ts.base = make(map[string]*AuthorKey)
+	}
+	ts.base[id] = &AuthorKey{ID: id, Key: key, Admin: admin}
+	ts.set(id, key, admin)
+}
+
+func (ts *TrustStore) set(id string, key ed25519.PublicKey, admin bool) {
+	if ts.keys == nil {
+		ts.keys = make(map[string]*AuthorKey)
+	}
+	ts.keys[id] = &AuthorKey{ID: id, Key: key, Admin: admin}
+}
+
+// reset drops every change made by trust events, going back to the base
+// keys.
+func (ts *TrustStore) reset() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.keys = make(map[string]*AuthorKey, len(ts.base))
+	for id, key := range ts.base {
+		ts.keys[id] = key
+	}
+}
+
+// fork returns a store holding only the base keys, for replaying the trust
+// events of a branch other than the canonical one.
+func (ts *TrustStore) fork() *TrustStore {
+	if ts == nil {
+		return nil
+	}
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	forked := &TrustStore{base: ts.base, keys: make(map[string]*AuthorKey, len(ts.base))}
+	for id, key := range ts.base {
+		forked.keys[id] = key
+	}
+	return forked
+}
+
+// rotate replaces the key of id, keeping whether it is an admin.
+func (ts *TrustStore) rotate(id string, key ed25519.PublicKey) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if author, ok := ts.keys[id]; ok {
+		ts.keys[id] = &AuthorKey{ID: id, Key: key, Admin: author.Admin}
+	}
+}
+
+func (ts *TrustStore) Remove(id string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	delete(ts.base, id)
+	delete(ts.keys, id)
+}
+
+func (ts *TrustStore) Lookup(id string) *AuthorKey {
+	if ts == nil {
+		return nil
+	}
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	return ts.keys[id]
+}
+
+func (ts *TrustStore) List() []AuthorKey {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	var keys []AuthorKey
+	for _, key := range ts.keys {
+		keys = append(keys, *key)
+	}
+	return keys
+}
+
+// Verify checks that event is signed by an authorized key matching its
+// author, and that trust events come from an admin and are well formed.
+func (ts *TrustStore) Verify(event *Event) error {
+	author := ts.Lookup(event.Author)
+	if author == nil {
+		return ErrUnknownAuthor
+	}
+	if !ed25519.Verify(author.Key, event.SignedData(), event.Signature) {
+		return ErrBadSignature
+	}
+	if event.Kind == "trust" {
+		var update TrustUpdate
+		if err := json.Unmarshal([]byte(event.Data), &update); err != nil {
+			return err
+		}
+		if update.Op == "rotate" {
+			if update.ID != event.Author || len(update.Key) != ed25519.PublicKeySize {
+				return errors.New("invalid key rotation")
+			}
+			if !ed25519.Verify(update.Key, rotationProof(update.ID, update.Key), update.Proof) {
+				return fmt.Errorf("key rotation: %w", ErrBadSignature)
+			}
+			return nil
+		}
+		if !author.Admin {
+			return errors.New("trust update from a non-admin key")
+		}
+		if update.Op != "add" && update.Op != "remove" {
+			return fmt.Errorf("unknown trust operation %q", update.Op)
+		}
+	}
+	return nil
+}
+
+// Apply carries out a trust event of the canonical chain. Its changes are
+// undone by reset.
+func (ts *TrustStore) Apply(event *Event) {
+	if ts == nil || event.Kind != "trust" {
+		return
+	}
+	var update TrustUpdate
+	if json.Unmarshal([]byte(event.Data), &update) != nil {
+		return
+	}
+	if update.Op == "rotate" && update.ID == event.Author && len(update.Key) == ed25519.PublicKeySize {
+		ts.rotate(update.ID, update.Key)
+		return
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if update.Op == "add" && len(update.Key) == ed25519.PublicKeySize {
+		ts.set(KeyID(update.Key), update.Key, update.Admin)
+	}
+	if update.Op == "remove" {
+		delete(ts.keys, update.ID)
+	}
+}
@@ -1,6 +1,10 @@
 package models
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"math/big"
 	"net"
 )
 
@@ -8,3 +12,33 @@ type Tuple struct {
 	Addr       *net.UDPAddr
 	Difficulty int
 }
+
+func NodeID(ip net.IP) string {
+	hash := sha1.New()
+	io.WriteString(hash, ip.String())
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func (t Tuple) AsPeer() *Peer {
+	return &Peer{
+		ID:         NodeID(t.Addr.IP),
+		Addr:       t.Addr,
+		Difficulty: t.Difficulty,
+		Generator:  big.NewInt(5),
+	}
+}
+
+// ValidID reports whether id is a node ID: 40 hex digits.
+func ValidID(id string) bool {
+	return len(id) == 40 && ValidKey(id)
+}
+
+// ValidKey reports whether key can be placed in the keyspace, which needs
+// at least the 16 hex digits distances are computed from.
+func ValidKey(key string) bool {
+	if len(key) < 16 {
+		return false
+	}
+	_, err := hex.DecodeString(key)
+	return err == nil
+}
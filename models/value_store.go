@@ -0,0 +1,388 @@
+package models
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"kademlia/constants"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ValueStore holds the values, records and provider records this node
+// stores for the DHT. Immutable values and records stored for other nodes
+// expire after VALUE_TTL unless stored again, and at most MaxValues values
+// and MaxRecords records are kept; those published by this node are kept
+// until it stops.
+type ValueStore struct {
+	CacheSize   int
+	MaxValues   int
+	MaxRecords  int
+	MaxProvided int
+	mu          sync.Mutex
+	records     map[string]*storedRecord
+	heldRecords int
+	values      map[string]*storedValue
+	held        int
+	cache       map[string]*cachedValue
+	providers   map[string][]*ProviderRecord
+}
+
+type storedValue struct {
+	value     []byte
+	expires   time.Time
+	published bool
+}
+
+type storedRecord struct {
+	record    *Record
+	expires   time.Time
+	published bool
+}
+
+type cachedValue struct {
+	value   []byte
+	expires time.Time
+}
+
+func ContentKey(value []byte) string {
+	hash := sha256.Sum256(value)
+	return hex.EncodeToString(hash[:])
+}
+
+func VerifyContent(key string, value []byte) error {
+	if ContentKey(value) != key {
+		return ErrHashMismatch
+	}
+	return nil
+}
+
+// Put keeps an immutable value stored by another node until VALUE_TTL
+// elapses, or extends the expiry of a value already held. Values can be as
+// large as a blob chunk.
+func (vs *ValueStore) Put(key string, value []byte) error {
+	return vs.put(key, value, false)
+}
+
+// Publish keeps an immutable value published by this node, which is never
+// evicted and is returned by Published for republishing.
+func (vs *ValueStore) Publish(key string, value []byte) error {
+	return vs.put(key, value, true)
+}
+
+func (vs *ValueStore) put(key string, value []byte, published bool) error {
+	if len(value) > constants.CHUNK_SIZE {
+		return ErrValueTooBig
+	}
+	if err := VerifyContent(key, value); err != nil {
+		return err
+	}
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	if vs.values == nil {
+		vs.values = make(map[string]*storedValue)
+	}
+	expires := time.Now().Add(constants.VALUE_TTL * time.Second)
+	if stored, ok := vs.values[key]; ok {
+		stored.expires = expires
+		if published && !stored.published {
+			stored.published = true
+			vs.held -= 1
+		}
+		return nil
+	}
+	if !published {
+		max := vs.MaxValues
+		if max == 0 {
+			max = constants.MAX_VALUES
+		}
+		if vs.held >= max {
+			vs.expire()
+		}
+		if vs.held >= max {
+			return ErrStoreFull
+		}
+		vs.held += 1
+	}
+	vs.values[key] = &storedValue{value: value, expires: expires, published: published}
+	return nil
+}
+
+// expire drops the values stored for other nodes whose expiry passed.
+func (vs *ValueStore) expire() {
+	now := time.Now()
+	for key, stored := range vs.values {
+		if !stored.published && !stored.expires.After(now) {
+			delete(vs.values, key)
+			vs.held -= 1
+		}
+	}
+}
+
+// expireRecords drops the records stored for other nodes whose expiry
+// passed.
+func (vs *ValueStore) expireRecords() {
+	now := time.Now()
+	for key, stored := range vs.records {
+		if !stored.published && !stored.expires.After(now) {
+			delete(vs.records, key)
+			vs.heldRecords -= 1
+		}
+	}
+}
+
+// Published returns the values this node published, keyed by key.
+func (vs *ValueStore) Published() map[string][]byte {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	published := make(map[string][]byte)
+	for key, stored := range vs.values {
+		if stored.published {
+			published[key] = stored.value
+		}
+	}
+	return published
+}
+
+// Cache keeps a value found by a lookup until ttl elapses. At most CacheSize
+// values are cached; when full, the one closest to expiry is evicted.
+func (vs *ValueStore) Cache(key string, value []byte, ttl time.Duration) error {
+	if len(value) > constants.CHUNK_SIZE {
+		return ErrValueTooBig
+	}
+	if err := VerifyContent(key, value); err != nil {
+		return err
+	}
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	if _, ok := vs.values[key]; ok {
+		return nil
+	}
+	if vs.cache == nil {
+		vs.cache = make(map[string]*cachedValue)
+	}
+	size := vs.CacheSize
+	if size == 0 {
+		size = constants.CACHE_SIZE
+	}
+	now := time.Now()
+	for cachedKey, cached := range vs.cache {
+		if !cached.expires.After(now) {
+			delete(vs.cache, cachedKey)
+		}
+	}
+	if _, ok := vs.cache[key]; !ok && len(vs.cache) >= size {
+		var oldest string
+		for cachedKey, cached := range vs.cache {
+			if oldest == "" || cached.expires.Before(vs.cache[oldest].expires) {
+				oldest = cachedKey
+			}
+		}
+		delete(vs.cache, oldest)
+	}
+	if size > 0 {
+		vs.cache[key] = &cachedValue{value: value, expires: now.Add(ttl)}
+	}
+	return nil
+}
+
+func (vs *ValueStore) Get(key string) []byte {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	if stored, ok := vs.values[key]; ok {
+		if stored.published || stored.expires.After(time.Now()) {
+			return stored.value
+		}
+		delete(vs.values, key)
+		vs.held -= 1
+	}
+	if cached, ok := vs.cache[key]; ok {
+		if cached.expires.After(time.Now()) {
+			return cached.value
+		}
+		delete(vs.cache, key)
+	}
+	return nil
+}
+
+// PutRecord keeps a record stored by another node until VALUE_TTL elapses,
+// or replaces the one held under its key if its sequence number is higher.
+func (vs *ValueStore) PutRecord(record *Record) error {
+	return vs.putRecord(record, false)
+}
+
+// PublishRecord keeps a record published by this node, which is never
+// evicted and is returned by PublishedRecords for republishing.
+func (vs *ValueStore) PublishRecord(record *Record) error {
+	return vs.putRecord(record, true)
+}
+
+func (vs *ValueStore) putRecord(record *Record, published bool) error {
+	if err := record.Verify(); err != nil {
+		return err
+	}
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	if vs.records == nil {
+		vs.records = make(map[string]*storedRecord)
+	}
+	key := record.Key()
+	expires := time.Now().Add(constants.VALUE_TTL * time.Second)
+	if stored, ok := vs.records[key]; ok {
+		current := stored.record
+		if record.Seq < current.Seq || (record.Seq == current.Seq && !bytes.Equal(record.Value, current.Value)) {
+			return ErrStaleRecord
+		}
+		stored.record = record
+		stored.expires = expires
+		if published && !stored.published {
+			stored.published = true
+			vs.heldRecords -= 1
+		}
+		return nil
+	}
+	if !published {
+		max := vs.MaxRecords
+		if max == 0 {
+			max = constants.MAX_RECORDS
+		}
+		if vs.heldRecords >= max {
+			vs.expireRecords()
+		}
+		if vs.heldRecords >= max {
+			return ErrStoreFull
+		}
+		vs.heldRecords += 1
+	}
+	vs.records[key] = &storedRecord{record: record, expires: expires, published: published}
+	return nil
+}
+
+// PublishedRecords returns the records this node published.
+func (vs *ValueStore) PublishedRecords() []*Record {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	var published []*Record
+	for _, stored := range vs.records {
+		if stored.published {
+			published = append(published, stored.record)
+		}
+	}
+	return published
+}
+
+// Keys returns the sorted keys of the immutable values stored, leaving out
+// cached ones.
+func (vs *ValueStore) Keys() []string {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	vs.expire()
+	var keys []string
+	for key := range vs.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (vs *ValueStore) GetRecord(key string) *Record {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	stored, ok := vs.records[key]
+	if !ok {
+		return nil
+	}
+	if !stored.published && !stored.expires.After(time.Now()) {
+		delete(vs.records, key)
+		vs.heldRecords -= 1
+		return nil
+	}
+	return stored.record
+}
+
+// AddProvider records provider for key until ttl elapses. Each key keeps at
+// most MAX_PROVIDERS entries; when full, the one closest to expiry is replaced.
+// Providers are kept for at most MaxProvided keys.
+func (vs *ValueStore) AddProvider(key string, provider Tuple, ttl time.Duration) error {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	if vs.providers == nil {
+		vs.providers = make(map[string][]*ProviderRecord)
+	}
+	record := &ProviderRecord{Provider: provider, Expires: time.Now().Add(ttl)}
+	records := vs.liveProviders(key)
+	for i, current := range records {
+		if current.Provider.Addr.String() == provider.Addr.String() {
+			records[i] = record
+			vs.providers[key] = records
+			return nil
+		}
+	}
+	if len(records) == 0 {
+		max := vs.MaxProvided
+		if max == 0 {
+			max = constants.MAX_PROVIDED_KEYS
+		}
+		if len(vs.providers) >= max {
+			vs.expireProviders()
+		}
+		if len(vs.providers) >= max {
+			return ErrStoreFull
+		}
+	}
+	if len(records) < constants.MAX_PROVIDERS {
+		vs.providers[key] = append(records, record)
+		return nil
+	}
+	oldest := 0
+	for i, current := range records {
+		if current.Expires.Before(records[oldest].Expires) {
+			oldest = i
+		}
+	}
+	records[oldest] = record
+	vs.providers[key] = records
+	return nil
+}
+
+func (vs *ValueStore) GetProviders(key string) []Tuple {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	var providers []Tuple
+	for _, record := range vs.liveProviders(key) {
+		providers = append(providers, record.Provider)
+	}
+	return providers
+}
+
+func (vs *ValueStore) liveProviders(key string) []*ProviderRecord {
+	var live []*ProviderRecord
+	now := time.Now()
+	for _, record := range vs.providers[key] {
+		if record.Expires.After(now) {
+			live = append(live, record)
+		}
+	}
+	if len(live) == 0 {
+		delete(vs.providers, key)
+	} else {
+		vs.providers[key] = live
+	}
+	return live
+}
+
+// expireProviders drops the provider records whose expiry passed, and the
+// keys left without any.
+func (vs *ValueStore) expireProviders() {
+	for key := range vs.providers {
+		vs.liveProviders(key)
+	}
+}
+
+// ExpireProviders drops the expired provider records of every key.
+func (vs *ValueStore) ExpireProviders() {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	vs.expireProviders()
+}
@@ -0,0 +1,86 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestContentVerification(t *testing.T) {
+	var vs ValueStore
+	value := []byte("immutable")
+	if err := vs.Put(ContentKey([]byte("other")), value); !errors.Is(err, ErrHashMismatch) {
+		t.Fatalf("storing under the wrong key gave %v", err)
+	}
+	if err := vs.Put(ContentKey(value), value); err != nil {
+		t.Fatal(err)
+	}
+
+	s := startTestServer(t, "127.0.0.2")
+	if err := testPeer(s).Store(ContentKey([]byte("other")), value); err == nil {
+		t.Fatal("node accepted a value that doesn't hash to its key")
+	}
+
+	// A node serving poisoned content is ignored by readers.
+	key := ContentKey(value)
+	s.Values.mu.Lock()
+	s.Values.values = map[string]*storedValue{key: {value: []byte("poison"), published: true}}
+	s.Values.mu.Unlock()
+	client := newTestServer("127.0.0.3")
+	client.Table.AddPeer(testPeer(s))
+	if got, err := client.Get(key); err == nil {
+		t.Fatalf("got %q from a poisoned node", got)
+	}
+}
+
+func TestValueLimits(t *testing.T) {
+	vs := ValueStore{MaxValues: 3}
+	var keys []string
+	for i := 0; i < 4; i++ {
+		value := []byte(fmt.Sprint("value ", i))
+		keys = append(keys, ContentKey(value))
+		err := vs.Put(keys[i], value)
+		if i < 3 && err != nil {
+			t.Fatal(err)
+		}
+		if i == 3 && !errors.Is(err, ErrStoreFull) {
+			t.Fatalf("storing beyond the limit gave %v", err)
+		}
+	}
+	own := []byte("published here")
+	if err := vs.Publish(ContentKey(own), own); err != nil {
+		t.Fatalf("publishing on a full store: %v", err)
+	}
+
+	vs.values[keys[0]].expires = time.Now().Add(-time.Second)
+	if vs.Get(keys[0]) != nil {
+		t.Fatal("expired value returned")
+	}
+	value := []byte("value 3")
+	if err := vs.Put(keys[3], value); err != nil {
+		t.Fatalf("storing after a value expired: %v", err)
+	}
+	vs.values[ContentKey(own)].expires = time.Now().Add(-time.Second)
+	if vs.Get(ContentKey(own)) == nil || len(vs.Keys()) != 4 {
+		t.Fatal("published value expired")
+	}
+	if published := vs.Published(); len(published) != 1 || string(published[ContentKey(own)]) != string(own) {
+		t.Fatalf("published %v", published)
+	}
+}
+
+func TestRepublish(t *testing.T) {
+	a := startTestServer(t, "127.0.0.2")
+	value := []byte("republished")
+	key, err := a.Put(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := startTestServer(t, "127.0.0.3")
+	a.Table.AddPeer(testPeer(b))
+	a.republish()
+	if string(b.Values.Get(key)) != string(value) {
+		t.Fatal("value not republished to a new close node")
+	}
+}
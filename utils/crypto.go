@@ -1,40 +1,187 @@
 package utils
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/pbkdf2"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509/pkix"
+	"encoding/asn1"
 	"encoding/base64"
+	"errors"
+	"fmt"
 	"io"
 )
 
-func Encrypt(data []byte, key []byte) string {
+func Encrypt(data []byte, key []byte) (string, error) {
 	block, err := aes.NewCipher(key)
-	CheckError(err)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrBadKey, err)
+	}
 	gcm, err := cipher.NewGCM(block)
-	CheckError(err)
+	if err != nil {
+		return "", err
+	}
 	iv := make([]byte, gcm.NonceSize())
-	io.ReadFull(rand.Reader, iv)
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return "", err
+	}
 	ciphertext := gcm.Seal(iv, iv, data, nil)
 	buf := make([]byte, 5)
-	_, err = rand.Read(buf)
-	CheckError(err)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
 	ciphertext = append(buf, ciphertext...)
-	return base64.StdEncoding.EncodeToString(ciphertext)
+	return base64.StdEncoding.EncodeToString(ciphertext), nil
 }
 
-func Decrypt(ciphertext string, key []byte) string {
-	textBytes, _ := base64.StdEncoding.DecodeString(ciphertext)
+func Decrypt(ciphertext string, key []byte) (string, error) {
+	textBytes, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrDecrypt, err)
+	}
 	block, err := aes.NewCipher(key)
-	CheckError(err)
-	if len(textBytes) < aes.BlockSize {
-		panic("ciphertext too short")
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrBadKey, err)
 	}
-	iv := textBytes[5:17]
-	textBytes = textBytes[17:]
 	gcm, err := cipher.NewGCM(block)
-	CheckError(err)
+	if err != nil {
+		return "", err
+	}
+	if len(textBytes) < 5+gcm.NonceSize()+gcm.Overhead() {
+		return "", fmt.Errorf("%w: ciphertext too short", ErrDecrypt)
+	}
+	iv := textBytes[5 : 5+gcm.NonceSize()]
+	textBytes = textBytes[5+gcm.NonceSize():]
 	plaintext, err := gcm.Open(nil, iv, textBytes, nil)
-	CheckError(err)
-	return string(plaintext)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrDecrypt, err)
+	}
+	return string(plaintext), nil
+}
+
+var (
+	oidPBES2      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES256CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Data      []byte
+}
+
+type pbes2Params struct {
+	KDF    pkix.AlgorithmIdentifier
+	Scheme pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt       []byte
+	Iterations int
+	KeyLength  int                      `asn1:"optional"`
+	PRF        pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// EncryptPKCS8 encrypts a PKCS#8 private key into an EncryptedPrivateKeyInfo
+// (RFC 5958) using PBES2 with PBKDF2-HMAC-SHA256 and AES-256-CBC, the
+// format of an "ENCRYPTED PRIVATE KEY" PEM block.
+func EncryptPKCS8(der []byte, passphrase []byte, iterations int) ([]byte, error) {
+	salt := make([]byte, 16)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	key, err := pbkdf2.Key(sha256.New, string(passphrase), salt, iterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	padding := aes.BlockSize - len(der)%aes.BlockSize
+	data := append(append([]byte{}, der...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+
+	kdf, err := asn1.Marshal(pbkdf2Params{
+		Salt:       salt,
+		Iterations: iterations,
+		PRF:        pkix.AlgorithmIdentifier{Algorithm: oidHMACSHA256, Parameters: asn1.NullRawValue},
+	})
+	if err != nil {
+		return nil, err
+	}
+	ivParam, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	params, err := asn1.Marshal(pbes2Params{
+		KDF:    pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: kdf}},
+		Scheme: pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivParam}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: params}},
+		Data:      data,
+	})
+}
+
+// DecryptPKCS8 reverses EncryptPKCS8, returning ErrDecrypt if the
+// passphrase is wrong.
+func DecryptPKCS8(der []byte, passphrase []byte) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, err
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("unsupported key encryption %v", info.Algorithm.Algorithm)
+	}
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, err
+	}
+	var kdf pbkdf2Params
+	if !params.KDF.Algorithm.Equal(oidPBKDF2) {
+		return nil, fmt.Errorf("unsupported key derivation %v", params.KDF.Algorithm)
+	}
+	if _, err := asn1.Unmarshal(params.KDF.Parameters.FullBytes, &kdf); err != nil {
+		return nil, err
+	}
+	if !kdf.PRF.Algorithm.Equal(oidHMACSHA256) || kdf.Iterations <= 0 || (kdf.KeyLength != 0 && kdf.KeyLength != 32) {
+		return nil, errors.New("unsupported PBKDF2 parameters")
+	}
+	var iv []byte
+	if !params.Scheme.Algorithm.Equal(oidAES256CBC) {
+		return nil, fmt.Errorf("unsupported key cipher %v", params.Scheme.Algorithm)
+	}
+	if _, err := asn1.Unmarshal(params.Scheme.Parameters.FullBytes, &iv); err != nil || len(iv) != aes.BlockSize {
+		return nil, errors.New("invalid AES-CBC parameters")
+	}
+	if len(info.Data) == 0 || len(info.Data)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("%w: truncated key", ErrDecrypt)
+	}
+	key, err := pbkdf2.Key(sha256.New, string(passphrase), kdf.Salt, kdf.Iterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, len(info.Data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(data, info.Data)
+	padding := int(data[len(data)-1])
+	if padding == 0 || padding > aes.BlockSize || !bytes.Equal(data[len(data)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+		return nil, ErrDecrypt
+	}
+	return data[:len(data)-padding], nil
 }
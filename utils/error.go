@@ -1,9 +1,8 @@
 package utils
 
-import "fmt"
+import "errors"
 
-func CheckError(err error) {
-	if err != nil {
-		fmt.Println(err)
-	}
-}
+var (
+	ErrBadKey  = errors.New("invalid session key")
+	ErrDecrypt = errors.New("cannot decrypt message")
+)
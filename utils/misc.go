@@ -1,9 +1,11 @@
 package utils
 
 import (
+	"crypto/sha1"
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"math"
 	"strconv"
 	"strings"
@@ -44,3 +46,33 @@ func GetTargetRange(length int, difficulty int) (uint64, uint64) {
 	minBytes, _ := hex.DecodeString(strings.Repeat(strconv.Itoa(difficulty), difficulty) + strings.Repeat(fmt.Sprintf("%x", difficulty+1), length-difficulty))
 	return binary.BigEndian.Uint64(minBytes), binary.BigEndian.Uint64(maxBytes)
 }
+
+func Distance(a string, b string) uint64 {
+	aBytes, _ := hex.DecodeString(a)
+	bBytes, _ := hex.DecodeString(b)
+	if len(aBytes) < 8 || len(bBytes) < 8 {
+		return math.MaxUint64
+	}
+	return binary.BigEndian.Uint64(aBytes) ^ binary.BigEndian.Uint64(bBytes)
+}
+
+func MerkleRoot(leaves []string) string {
+	if len(leaves) == 0 {
+		return ""
+	}
+	leaves = append([]string{}, leaves...)
+	for len(leaves) > 1 {
+		if len(leaves)&1 == 1 {
+			leaves = append(leaves, leaves[len(leaves)-1])
+		}
+		var newLeaves []string
+		for i := 0; i < len(leaves); i += 2 {
+			h := sha1.New()
+			io.WriteString(h, leaves[i]+leaves[i+1])
+			leaf := fmt.Sprintf("%x", h.Sum(nil))
+			newLeaves = append(newLeaves, leaf)
+		}
+		leaves = newLeaves
+	}
+	return leaves[0]
+}